@@ -2,12 +2,14 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
 	"regexp"
@@ -31,9 +33,16 @@ var hasFlags arrayFlags
 var mergeFlag string
 var debugFlag bool
 var rootFlag string
+var overlayRootFlag string
 var validateFlag bool
 var versionFlag bool
 var gitFlag bool
+var requireCleanFlag bool
+var keyringFlag string
+var gitDirFlag string
+var workTreeFlag string
+var requireSignedFlag bool
+var strictFlag bool
 var outputFlag string
 var dirFlag string
 
@@ -103,9 +112,22 @@ Examples:
 	flags.StringVar(&rootFlag, "root", "", `The top directory of the agnosticv files. Files outside of this directory will not be merged.
 By default, it's empty, and the scope of the git repository is used, so you should not
 need this parameter unless your files are not in a git repository, or if you want to use a subdir. Use -root flag with -merge.`)
+	flags.StringVar(&overlayRootFlag, "overlay-root", "", `The top directory of other agnosticv files to merge on top of the files of --root.
+Common files and includes are looked up in both trees, and the files of the overlay are merged after the files of the root.`)
 	flags.BoolVar(&versionFlag, "version", false, "Print build version.")
-	flags.BoolVar(&gitFlag, "git", true, "Perform git operations to gather and inject information into the merged vars like 'last_update'. Git operations are slow so this option is automatically disabled for listing.")
+	flags.BoolVar(&gitFlag, "git", true, `Perform git operations to gather and inject information into the merged vars like 'last_update'.
+Git operations are slow so this option is automatically disabled for listing, unless explicitly set.
+When listing with --git, the history is walked once for all the catalog items.`)
+	flags.BoolVar(&requireCleanFlag, "require-clean", false, "Fail the merge if files in the merge list have uncommitted changes. Requires git operations.")
+	flags.StringVar(&gitDirFlag, "git-dir", os.Getenv("GIT_DIR"), `Path to the git repository, when it is not in the .git directory of the agnosticv files.
+Default is the value of the GIT_DIR environment variable.`)
+	flags.StringVar(&workTreeFlag, "work-tree", os.Getenv("GIT_WORK_TREE"), `The top directory of the working tree, to use with --git-dir. Also used as --root if not set.
+Default is the value of the GIT_WORK_TREE environment variable, or --root.`)
+	flags.StringVar(&keyringFlag, "keyring", "", `Verify the signature of the last commit against this keyring and record it in '__meta__.last_update.git.signature'.
+Either an armored GPG keyring or an SSH allowed signers file. Overrides 'keyring' in .agnosticv.yaml.`)
+	flags.BoolVar(&requireSignedFlag, "require-signed", false, "Fail the merge if the last commit is not signed by a key of the keyring. Requires git operations.")
 	flags.StringVar(&outputFlag, "output", "", "Output format. Possible values: json or yaml. Default is 'yaml' for merging.")
+	flags.BoolVar(&strictFlag, "strict", false, "Fail on duplicate keys in YAML files, instead of printing a warning.")
 
 	if err := flags.Parse(args[1:]); err != nil {
 		flags.PrintDefaults()
@@ -181,6 +203,34 @@ need this parameter unless your files are not in a git repository, or if you wan
 		}
 	}
 
+	if gitDirFlag != "" {
+		if !fileExists(gitDirFlag) {
+			fmt.Fprintln(output, "Error: git dir", gitDirFlag, "does not exist")
+			return controlFlow{true, 1}
+		}
+		gitDirFlag = abs(gitDirFlag)
+	}
+
+	if workTreeFlag != "" {
+		if !fileExists(workTreeFlag) {
+			fmt.Fprintln(output, "Error: work tree", workTreeFlag, "does not exist")
+			return controlFlow{true, 1}
+		}
+		workTreeFlag = abs(workTreeFlag)
+
+		if rootFlag == "" {
+			rootFlag = workTreeFlag
+		}
+	}
+
+	if overlayRootFlag != "" {
+		if !fileExists(overlayRootFlag) {
+			fmt.Fprintln(output, "Error: overlay root", overlayRootFlag, "does not exist")
+			return controlFlow{true, 1}
+		}
+		overlayRootFlag = abs(overlayRootFlag)
+	}
+
 	if rootFlag != "" {
 		if !fileExists(rootFlag) {
 			log.Fatalf("File %s does not exist", rootFlag)
@@ -224,9 +274,35 @@ need this parameter unless your files are not in a git repository, or if you wan
 		}
 	}
 
-	// Do not perform git operations when listing
+	// Do not perform git operations when listing, unless explicitly asked
 	if listFlag {
-		gitFlag = false
+		gitFlagSet := false
+		flags.Visit(func(f *flag.Flag) {
+			if f.Name == "git" {
+				gitFlagSet = true
+			}
+		})
+		if !gitFlagSet {
+			gitFlag = false
+		}
+	}
+
+	if requireCleanFlag && !gitFlag {
+		fmt.Fprintln(output, "You cannot use --require-clean without git operations.")
+		return controlFlow{true, 2}
+	}
+
+	if requireSignedFlag && !gitFlag {
+		fmt.Fprintln(output, "You cannot use --require-signed without git operations.")
+		return controlFlow{true, 2}
+	}
+
+	if keyringFlag != "" {
+		if !fileExists(keyringFlag) {
+			fmt.Fprintln(output, "Error: keyring", keyringFlag, "does not exist")
+			return controlFlow{true, 1}
+		}
+		keyringFlag = abs(keyringFlag)
 	}
 
 	if debugFlag {
@@ -281,27 +357,31 @@ func isPathCatalogItem(root, p string) bool {
 		}
 	}
 
-	switch path.Base(p) {
-	case "common.yml", "common.yaml", "account.yml", "account.yaml":
+	if isCommonFileName(path.Base(p)) {
+		return false
+	}
+
+	// Ignore the paths excluded by .agnosticvignore files
+	if isIgnored(root, p, false) {
 		return false
 	}
 
 	// Don't consider related file as catalog items
-	if config.initialized {
-		for _, el := range config.RelatedFiles {
+	if c := configFor(filepath.Dir(p)); c.initialized {
+		for _, el := range c.RelatedFiles {
 			if path.Base(p) == el {
 				return false
 			}
 		}
-		for _, el := range config.RelatedFilesV2 {
+		for _, el := range c.RelatedFilesV2 {
 			if path.Base(p) == el.File {
 				return false
 			}
 		}
 	}
 
-	// Catalog items are yaml files only.
-	if !strings.HasSuffix(p, ".yml") && !strings.HasSuffix(p, ".yaml") {
+	// Catalog items are YAML or JSON files only.
+	if !hasVarsExtension(p) {
 		return false
 	}
 
@@ -312,6 +392,21 @@ func isPathCatalogItem(root, p string) bool {
 	return true
 }
 
+// varsExtensions are the extensions of the files containing vars:
+// catalog items, common files, meta files and includes.
+var varsExtensions = []string{".yml", ".yaml", ".json"}
+
+// hasVarsExtension returns true if p is a YAML or a JSON file.
+func hasVarsExtension(p string) bool {
+	ext := filepath.Ext(p)
+	for _, varsExtension := range varsExtensions {
+		if ext == varsExtension {
+			return true
+		}
+	}
+	return false
+}
+
 var regexNotCatalogItem = regexp.MustCompile(`^#[ \t]*agnosticv[ \t]+catalog_item[ \t]+false[ \t]*$`)
 
 // isCatalogItem checks if a path is a valid catalog item.
@@ -325,15 +420,14 @@ func isCatalogItem(root, p string) bool {
 	if !fileExists(p) {
 		return false
 	}
-	file, err := os.Open(p)
+	content, err := readFile(p)
 
 	if err != nil {
 		logErr.Printf("%v\n", err)
 		return false
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
 
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -348,17 +442,29 @@ func isCatalogItem(root, p string) bool {
 }
 
 func extendMergeListWithRelated(pAbs string, mergeList []Include) []Include {
-	// Related == merge list + description.{adoc,html} + config.related_files
+	// Related == merge list + files loaded with tags + description.{adoc,html} + config.related_files
+
+	result := append([]Include{}, mergeList...)
 
-	result := append(
-		mergeList,
+	loaded := map[string]bool{}
+	for _, include := range mergeList {
+		for _, p := range tagFiles(include.path) {
+			if !loaded[p] {
+				result = append(result, Include{path: p})
+				loaded[p] = true
+			}
+		}
+	}
+
+	result = append(
+		result,
 		Include{path: filepath.Join(filepath.Dir(pAbs), "description.adoc")},
 		Include{path: filepath.Join(filepath.Dir(pAbs), "description.html")},
 	)
 
 	done := map[string]bool{}
-	if config.initialized {
-		for _, el := range config.RelatedFiles {
+	if c := configFor(filepath.Dir(pAbs)); c.initialized {
+		for _, el := range c.RelatedFiles {
 			if _, ok := done[el]; ok {
 				continue
 			}
@@ -368,7 +474,7 @@ func extendMergeListWithRelated(pAbs string, mergeList []Include) []Include {
 			)
 			done[el] = true
 		}
-		for _, el := range config.RelatedFilesV2 {
+		for _, el := range c.RelatedFilesV2 {
 			if _, ok := done[el.File]; ok {
 				continue
 			}
@@ -413,6 +519,14 @@ func findCatalogItems(workdir string, hasFlags []string, relatedFlags []string,
 			return nil
 		}
 
+		// Skip the directories excluded by .agnosticvignore files
+		if info.IsDir() {
+			if pAbs, err := filepath.Abs(p); err == nil && isIgnored(rootFlag, pAbs, true) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
 		// TODO: create a CatalogItem type that will use absolute path and make the validations isCatalogItem()
 		pAbs, err := filepath.Abs(p)
 		if err == nil {
@@ -533,7 +647,7 @@ func findCatalogItems(workdir string, hasFlags []string, relatedFlags []string,
 }
 
 func fileExists(filename string) bool {
-	if _, err := os.Stat(filename); err == nil {
+	if _, err := statFile(filename); err == nil {
 		return true
 	} else if os.IsNotExist(err) {
 		return false
@@ -547,7 +661,7 @@ func fileExists(filename string) bool {
 // This function works with both Relative and Absolute path
 func parentDir(path string) string {
 	logDebug.Println("parentDir(", path, ")")
-	fileinfo, err := os.Stat(path)
+	fileinfo, err := statFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return filepath.Dir(path)
@@ -589,13 +703,14 @@ func abs(item string) string {
 	}
 	return itemAbs
 }
+
+// findRoot returns the root directory of the agnosticv files containing item:
+// the top directory of the git repository, or if there is no .git in any parent
+// directory, for example in an exported tree, the top-most directory containing
+// a .agnosticv.yaml file.
 func findRoot(item string) string {
 	item = abs(item)
 
-	if item == "/" {
-		log.Fatal("Root not found.")
-	}
-
 	fileinfo, err := os.Stat(item)
 
 	if err != nil {
@@ -606,36 +721,151 @@ func findRoot(item string) string {
 		log.Fatal(item, err.Error())
 	}
 
-	// If it's a dir, run with current directory
-	if fileinfo.IsDir() {
-		if fileExists(filepath.Join(item, ".git")) {
-			// .git dir exists, root found.
-			return item
+	dir := item
+	if !fileinfo.IsDir() {
+		dir = filepath.Dir(item)
+	}
+
+	markerRoot := ""
+	for {
+		if fileExists(filepath.Join(dir, ".git")) {
+			// .git exists, root found.
+			return dir
 		}
+
+		if fileExists(filepath.Join(dir, ".agnosticv.yaml")) {
+			markerRoot = dir
+		}
+
+		if dir == "/" {
+			break
+		}
+		dir = filepath.Dir(dir)
 	}
 
-	return findRoot(parentDir(item))
+	if markerRoot == "" {
+		log.Fatal("Root not found.")
+	}
+
+	return markerRoot
+}
+
+// defaultCommonFileNames are the names of the common files, in merge order,
+// when common_files is not set in the configuration file.
+var defaultCommonFileNames = []string{
+	"account.yaml",
+	"account.yml",
+	"account.json",
+	"common.yaml",
+	"common.yml",
+	"common.json",
+}
+
+// commonFileNames returns the names of the common files, in merge order:
+// in a directory, a common file overrides the common files listed before it.
+func commonFileNames() []string {
+	if len(config.CommonFiles) > 0 {
+		return config.CommonFiles
+	}
+	return defaultCommonFileNames
+}
+
+func isCommonFileName(name string) bool {
+	for _, commonFile := range commonFileNames() {
+		if name == commonFile {
+			return true
+		}
+	}
+	return false
+}
+
+// warnedCommonDirs records the directories with ambiguous common files already reported.
+var warnedCommonDirs = map[string]bool{}
+
+// warnAmbiguousCommonFiles warns when a directory contains the same common
+// file with several extensions, ex: common.yaml and common.yml. All are merged.
+func warnAmbiguousCommonFiles(dir string) {
+	if warnedCommonDirs[dir] {
+		return
+	}
+	warnedCommonDirs[dir] = true
+
+	// Existing common files, by name without extension
+	found := map[string][]string{}
+	names := []string{}
+	for _, commonFile := range commonFileNames() {
+		name := strings.TrimSuffix(commonFile, filepath.Ext(commonFile))
+		if findCommonFile(filepath.Join(dir, commonFile)) == "" {
+			continue
+		}
+		if _, ok := found[name]; !ok {
+			names = append(names, name)
+		}
+		found[name] = append(found[name], commonFile)
+	}
+
+	for _, name := range names {
+		switch l := found[name]; len(l) {
+		case 1:
+		case 2:
+			logErr.Printf("WARNING: both %s and %s exist in %s, both are merged\n", l[0], l[1], dir)
+		default:
+			logErr.Printf("WARNING: %s and %s exist in %s, all are merged\n", strings.Join(l[:len(l)-1], ", "), l[len(l)-1], dir)
+		}
+	}
+}
+
+// findCommonFile returns the path of the common file, in the base tree or
+// in the overlay tree, or the empty string "" if it does not exist.
+func findCommonFile(candidate string) string {
+	if fileExists(candidate) {
+		return candidate
+	}
+	if overlay, ok := overlayPath(candidate); ok && fileExists(overlay) {
+		return overlay
+	}
+	return ""
+}
+
+// findCommonFileIn returns the last of names that exists in dir, or the empty
+// string "" if none exists. Common files are walked in reverse merge order.
+func findCommonFileIn(dir string, names []string) string {
+	for i := len(names) - 1; i >= 0; i-- {
+		if found := findCommonFile(filepath.Join(dir, names[i])); found != "" {
+			logDebug.Println("nextCommonFile found:", found)
+			return found
+		}
+	}
+	return ""
 }
 
 // This function return the next file to be included in the merge.
 // it returns the empty string "" if not found.
 // pos can be a directory or a file
+//
+// Common files are returned from the closest to the top directory, and in a
+// directory, in the reverse order of the common_files configuration.
 func nextCommonFile(position string) string {
 	logDebug.Println("nextCommonFile position:", position)
-	validCommonFileNames := []string{
-		"common.yaml",
-		"common.yml",
-		"account.yaml",
-		"account.yml",
-	}
 
-	// If position is a common file, try with parent dir
-	for _, commonFile := range validCommonFileNames {
+	names := commonFileNames()
+
+	// If position is a common file, try the common files before it in the
+	// same directory, then with parent dir
+	for i, commonFile := range names {
 		if path.Base(position) == commonFile {
+			dir := filepath.Dir(position)
+			if p, ok := basePath(dir); ok {
+				dir = p
+			}
+			if found := findCommonFileIn(dir, names[:i]); found != "" {
+				return found
+			}
+
 			// If parent is out of chroot, stop
-			if !isRoot(rootFlag, parentDir(position)) {
+			if !isRoot(rootFor(position), parentDir(position)) {
 				logDebug.Println("parent of", position, ",", parentDir(position),
-					"is out of chroot", rootFlag)
+					"is out of chroot", rootFor(position))
 				return ""
 			}
 
@@ -643,7 +873,19 @@ func nextCommonFile(position string) string {
 		}
 	}
 
-	fileinfo, err := os.Stat(position)
+	// With an overlay root, walk the directories of the base tree
+	if p, ok := basePath(position); ok {
+		position = p
+	}
+
+	fileinfo, err := statFile(position)
+
+	if os.IsNotExist(err) {
+		// The directory may exist only in the overlay
+		if overlay, ok := overlayPath(position); ok {
+			fileinfo, err = statFile(overlay)
+		}
+	}
 
 	if os.IsNotExist(err) {
 		logErr.Fatal(position, "File does not exist.")
@@ -654,12 +896,9 @@ func nextCommonFile(position string) string {
 		return nextCommonFile(filepath.Dir(position))
 	}
 
-	for _, commonFile := range validCommonFileNames {
-		candidate := filepath.Join(position, commonFile)
-		if fileExists(candidate) {
-			logDebug.Println("nextCommonFile found:", candidate)
-			return candidate
-		}
+	warnAmbiguousCommonFiles(position)
+	if found := findCommonFileIn(position, names); found != "" {
+		return found
 	}
 
 	if position == "/" {
@@ -667,29 +906,60 @@ func nextCommonFile(position string) string {
 	}
 
 	// If parent is out of chroot, stop
-	if !isRoot(rootFlag, parentDir(position)) {
+	if !isRoot(rootFor(position), parentDir(position)) {
 		logDebug.Println("parent of", position, ",", parentDir(position),
-			"is out of chroot", rootFlag)
+			"is out of chroot", rootFor(position))
 		return ""
 	}
 
 	return nextCommonFile(parentDir(position))
-
 }
 
 func main() {
 	initLoggers()
+
+	// Subcommands
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(runCheck(os.Args[1:], os.Stdout))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(runConfig(os.Args[1:], os.Stdout))
+	}
+
 	if flow := parseFlags(os.Args, os.Stdout); flow.stop {
 		os.Exit(flow.rc)
 	}
-	initConf(rootFlag)
+	// Only the configuration that applies is validated, see 'agnosticv config check'
+	// With --list, the items of all the subdirectories are listed
+	if mergeFlag != "" {
+		exitOnInvalidConfig(configFilesFor(filepath.Dir(abs(mergeFlag))))
+	} else {
+		paths, err := configFilesUnder(dirFlag)
+		if err != nil {
+			logErr.Fatal(err)
+		}
+		exitOnInvalidConfig(paths)
+	}
 	initMergeStrategies()
 
+	if requireSignedFlag && keyringPath() == "" {
+		logErr.Fatal(ErrorNoKeyring)
+	}
+
 	if len(schemas) == 0 {
 		initSchemaList()
 	}
 
 	if listFlag {
+		if gitFlag && isRepo(rootFlag) {
+			if _, err := exec.LookPath("git"); err != nil {
+				// If git is not in PATH, use pure-go
+				lastCommitIndex = buildCommitIndex(rootFlag)
+			} else {
+				lastCommitIndex = buildCommitIndexCmd(rootFlag)
+			}
+		}
+
 		catalogItems, err := findCatalogItems(dirFlag, hasFlags, relatedFlags, orRelatedFlags)
 
 		if err != nil {
@@ -741,7 +1011,7 @@ func main() {
 			out, _ := yaml.Marshal(merged)
 
 			fmt.Printf("---\n")
-			printMergeStrategies()
+			printMergeStrategies(mergeStrategiesFor(abs(mergeFlag), mergeStrategies))
 			printPaths(mergeList, workDir)
 			fmt.Printf("%s", out)
 		default:
@@ -1,13 +1,31 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 )
 
+// writeTestFiles writes files, by path relative to dir, creating the directories.
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
 func BenchmarkParentDir(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		parentDir("/a/b/c/d//e")
@@ -170,6 +188,43 @@ func TestResolvePath(t *testing.T) {
 	}
 }
 
+func TestIncludePaths(t *testing.T) {
+	initLoggers()
+	rootFlag = abs("fixtures")
+	initConf(rootFlag)
+	initSchemaList()
+	initMergeStrategies()
+
+	merged, _, err := mergeVars("fixtures/test/INCLUDE_SEARCH/search.yaml", mergeStrategies)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first include path wins
+	if merged["from_search"] != "first" {
+		t.Error("expected from_search = first, got", merged["from_search"])
+	}
+
+	if merged["from_second_only"] != "second" {
+		t.Error("expected from_second_only = second, got", merged["from_second_only"])
+	}
+
+	// The directory of the current file is searched first
+	merged, _, err = mergeVars("fixtures/test/INCLUDE_SEARCH/local/local-first.yaml", mergeStrategies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged["from_search"] != "local" {
+		t.Error("expected from_search = local, got", merged["from_search"])
+	}
+
+	// Explicit relative paths are not searched in include paths
+	logErr = log.New(io.Discard, "!!! ", log.LstdFlags)
+	if _, _, err := mergeVars("fixtures/test/INCLUDE_SEARCH/explicit.yaml", mergeStrategies); !errors.Is(err, ErrorIncludeNotFound) {
+		t.Error("ErrorIncludeNotFound expected, got", err)
+	}
+}
+
 func TestIsPathCatalogItem(t *testing.T) {
 	testCases := []struct {
 		root   string
@@ -240,6 +295,199 @@ func TestIsPathCatalogItem(t *testing.T) {
 	}
 }
 
+func TestIgnoreFile(t *testing.T) {
+	initLoggers()
+	root := abs("fixtures")
+
+	testCases := []struct {
+		path   string
+		result bool
+	}{
+		{"test/IGNORE/scratch/item.yaml", false},
+		{"test/IGNORE/docs/example.yaml", false},
+		{"test/IGNORE/item.generated.yaml", false},
+		{"test/IGNORE/keep.generated.yaml", true},
+		{"test/IGNORE/regular.yaml", true},
+		// Patterns of a directory don't apply to other directories
+		{"test/foo/item.generated.yaml", true},
+	}
+
+	for _, tc := range testCases {
+		if result := isPathCatalogItem(root, filepath.Join(root, tc.path)); result != tc.result {
+			t.Error("isPathCatalogItem(", tc.path, ") expected", tc.result, "got", result)
+		}
+	}
+
+	// Ignore file at the root
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{
+		ignoreFileName:         "wip/\n",
+		"catalog/dev.yaml":     "foo: dev\n",
+		"catalog/wip/dev.yaml": "foo: wip\n",
+		"wip/dev.yaml":         "foo: wip\n",
+	})
+
+	rootFlag = dir
+	initConf(rootFlag)
+	defer func() {
+		rootFlag = abs("fixtures")
+		initConf(rootFlag)
+	}()
+
+	items, err := findCatalogItems(dir, []string{}, []string{}, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(items, []string{"catalog/dev.yaml"}) {
+		t.Error("expected only catalog/dev.yaml, got", items)
+	}
+}
+
+func TestJSONCatalogItems(t *testing.T) {
+	initLoggers()
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{
+		"common.json":          `{"purpose": "json", "foo": "common"}`,
+		"team/common.yaml":     "team: yaml\n",
+		"team/dev.json":        "{\n\t\"__include__\": [\"/includes/base.json\"],\n\t\"foo\": \"dev\"\n}\n",
+		"team/dev.meta.json":   `{"__meta__": {"owner": "json"}}`,
+		"team/notes.txt":       "not a catalog item",
+		"includes/base.json":   `{"base": true}`,
+		".schemas/schema.json": `{"type": "object", "properties": {"foo": {"type": "string"}}}`,
+	})
+
+	rootFlag = dir
+	initConf(rootFlag)
+	defer func() {
+		rootFlag = abs("fixtures")
+		initConf(rootFlag)
+		schemas = nil
+		initSchemaList()
+	}()
+
+	items, err := findCatalogItems(dir, []string{}, []string{}, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(items, []string{"team/dev.json"}) {
+		t.Error("expected only team/dev.json, got", items)
+	}
+
+	merged, mergeList, err := mergeVars(filepath.Join(dir, "team", "dev.json"), mergeStrategies)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedList := []string{
+		"common.json",
+		"team/common.yaml",
+		"team/dev.meta.json",
+		"includes/base.json",
+		"team/dev.json",
+	}
+	if len(mergeList) != len(expectedList) {
+		t.Fatal("expected", expectedList, "got", mergeList)
+	}
+	for i, include := range mergeList {
+		if include.path != filepath.Join(dir, expectedList[i]) {
+			t.Error("expected", expectedList[i], "at position", i, "got", include.path)
+		}
+	}
+
+	for _, tc := range []struct {
+		pointer string
+		value   any
+	}{
+		{"/purpose", "json"},
+		{"/team", "yaml"},
+		{"/base", true},
+		{"/foo", "dev"},
+		{"/__meta__/owner", "json"},
+	} {
+		if _, v, _, err := Get(merged, tc.pointer); err != nil || v != tc.value {
+			t.Error(tc.pointer, "expected", tc.value, "got", v, err)
+		}
+	}
+	if _, ok := merged[includeKey]; ok {
+		t.Error(includeKey, "should not be in the merged vars")
+	}
+
+	schemas = nil
+	initSchemaList()
+	if len(schemas) != 1 {
+		t.Fatal("expected the JSON schema to be loaded, got", len(schemas), "schemas")
+	}
+	merged["foo"] = 42
+	if err := validateAgainstSchemas("team/dev.json", merged); err == nil {
+		t.Error("foo should be validated against the JSON schema")
+	}
+}
+
+func TestConfigLayering(t *testing.T) {
+	initLoggers()
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{
+		configFileName: "related_files:\n  - related.yaml\n",
+		"common.yaml":  "vars: {a: 1}\n",
+		"team/" + configFileName: `related_files:
+  - team-related.yaml
+related_files_v2:
+  - file: notes.txt
+    load_into: /__meta__/notes
+    content_key: text
+merge_strategies:
+  - path: /vars
+    strategy: merge
+`,
+		"team/dev.yaml":           "vars: {b: 2}\n",
+		"team/related.yaml":       "foo: bar\n",
+		"team/team-related.yaml":  "foo: bar\n",
+		"team/notes.txt":          "hello",
+		"other/dev.yaml":          "vars: {b: 2}\n",
+		"other/team-related.yaml": "foo: bar\n",
+	})
+
+	rootFlag = dir
+	initConf(rootFlag)
+	defer func() {
+		rootFlag = abs("fixtures")
+		initConf(rootFlag)
+	}()
+
+	// Related files of the root and of the subdirectory are layered
+	items, err := findCatalogItems(dir, []string{}, []string{}, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"other/dev.yaml", "other/team-related.yaml", "team/dev.yaml"}
+	if !reflect.DeepEqual(items, expected) {
+		t.Error("expected", expected, "got", items)
+	}
+
+	if c := configFor(filepath.Join(dir, "other")); len(c.MergeStrategies) != 0 {
+		t.Error("merge strategies of team/ must not apply to other/, got", c.MergeStrategies)
+	}
+
+	merged, _, err := mergeVars(filepath.Join(dir, "team", "dev.yaml"), mergeStrategies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(merged["vars"], map[string]any{"a": float64(1), "b": float64(2)}) {
+		t.Error("/vars should be merged in team/, got", merged["vars"])
+	}
+	if _, v, _, err := Get(merged, "/__meta__/notes/text"); err != nil || v != "hello" {
+		t.Error("notes.txt should be loaded into /__meta__/notes, got", v, err)
+	}
+
+	merged, _, err = mergeVars(filepath.Join(dir, "other", "dev.yaml"), mergeStrategies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(merged["vars"], map[string]any{"b": float64(2)}) {
+		t.Error("/vars should be replaced in other/, got", merged["vars"])
+	}
+}
+
 func TestWalk(t *testing.T) {
 	initLoggers()
 	prevDir, _ := os.Getwd()
@@ -349,8 +597,14 @@ func TestParseInclude(t *testing.T) {
 	testCases := []struct {
 		line      string
 		found     bool
+		err       bool
 		path      string
 		recursive bool
+		optional  bool
+		fragment  string
+		into      string
+		after     bool
+		params    map[string]string
 	}{
 		{
 			line:      "#include /path/ok",
@@ -403,6 +657,7 @@ func TestParseInclude(t *testing.T) {
 		{
 			line:      "#include /path  with space without quotes ",
 			found:     false,
+			err:       true,
 			path:      "",
 			recursive: true,
 		},
@@ -431,6 +686,137 @@ func TestParseInclude(t *testing.T) {
 			path:      "/path/ok",
 			recursive: false,
 		},
+		// Test cases for #include optional parameter
+		{
+			line:      "#include optional=true /path/ok",
+			found:     true,
+			path:      "/path/ok",
+			recursive: true,
+			optional:  true,
+		},
+		{
+			line:      "#include recursive=false optional=true \"/path/ok\"",
+			found:     true,
+			path:      "/path/ok",
+			recursive: false,
+			optional:  true,
+		},
+		{
+			line:      "#include optional=yes /path/ok",
+			found:     false,
+			err:       true,
+			path:      "",
+			recursive: true,
+		},
+		{
+			line:      "#include unknown=true /path/ok",
+			found:     false,
+			err:       true,
+			path:      "",
+			recursive: true,
+		},
+		// Test cases for JSON pointer fragments
+		{
+			line:      "#include /path/ok.yaml#/ocp4/large",
+			found:     true,
+			path:      "/path/ok.yaml",
+			recursive: true,
+			fragment:  "/ocp4/large",
+		},
+		{
+			line:      "#include \"/path/with space.yaml#/key\"",
+			found:     true,
+			path:      "/path/with space.yaml",
+			recursive: true,
+			fragment:  "/key",
+		},
+		// Test cases for #include into parameter
+		{
+			line:      "#include into=/__meta__/catalog/parameters /path/ok",
+			found:     true,
+			path:      "/path/ok",
+			recursive: true,
+			into:      "/__meta__/catalog/parameters",
+		},
+		{
+			line:      "#include into=parameters /path/ok",
+			found:     false,
+			err:       true,
+			path:      "",
+			recursive: true,
+		},
+		// Test cases for #include position parameter
+		{
+			line:      "#include position=after /path/ok",
+			found:     true,
+			path:      "/path/ok",
+			recursive: true,
+			after:     true,
+		},
+		{
+			line:      "#include position=before /path/ok",
+			found:     true,
+			path:      "/path/ok",
+			recursive: true,
+		},
+		{
+			line:      "#include position=last /path/ok",
+			found:     false,
+			err:       true,
+			path:      "",
+			recursive: true,
+		},
+		// Test cases for template parameters
+		{
+			line:      "#include /path/ok version=4.14 workers=3",
+			found:     true,
+			path:      "/path/ok",
+			recursive: true,
+			params:    map[string]string{"version": "4.14", "workers": "3"},
+		},
+		{
+			line:      "#include recursive=false \"/path/ok\" name=\"with space\"  ",
+			found:     true,
+			path:      "/path/ok",
+			recursive: false,
+			params:    map[string]string{"name": "with space"},
+		},
+		// Directive parameters after the path are not template parameters
+		{
+			line:      "#include /path/ok recursive=false",
+			found:     false,
+			err:       true,
+			path:      "",
+			recursive: true,
+		},
+		{
+			line:      "#include /path/ok optional=true",
+			found:     false,
+			err:       true,
+			path:      "",
+			recursive: true,
+		},
+		{
+			line:      "#include /path/ok position=after version=4.14",
+			found:     false,
+			err:       true,
+			path:      "",
+			recursive: true,
+		},
+		{
+			line:      "#include /path/ok into=/__meta__/catalog",
+			found:     false,
+			err:       true,
+			path:      "",
+			recursive: true,
+		},
+		{
+			line:      "#include /path/ok repo=common",
+			found:     false,
+			err:       true,
+			path:      "",
+			recursive: true,
+		},
 		// #merge is no longer supported
 		{
 			line:      "#merge /path/ok",
@@ -441,13 +827,17 @@ func TestParseInclude(t *testing.T) {
 	}
 
 	for _, tc := range testCases {
-		found, include := parseInclude(tc.line)
+		found, include, err := parseInclude(tc.line)
+		if (err != nil) != tc.err {
+			t.Errorf("TestCase failed: %v, got err=%v", tc, err)
+			continue
+		}
 		if found != tc.found {
 			t.Errorf("TestCase failed: %v, got found=%v", tc, found)
 			continue
 		}
-		if found && (include.path != tc.path || include.recursive != tc.recursive) {
-			t.Errorf("TestCase failed: %v, got found=%v path=%q recursive=%v", tc, found, include.path, include.recursive)
+		if found && (include.path != tc.path || include.recursive != tc.recursive || include.optional != tc.optional || include.fragment != tc.fragment || include.into != tc.into || include.after != tc.after || !reflect.DeepEqual(include.params, tc.params)) {
+			t.Errorf("TestCase failed: %v, got found=%v path=%q recursive=%v optional=%v fragment=%q into=%q after=%v params=%v", tc, found, include.path, include.recursive, include.optional, include.fragment, include.into, include.after, include.params)
 		}
 	}
 }
@@ -473,11 +863,550 @@ func TestInclude(t *testing.T) {
 	logErr = log.New(io.Discard, "!!! ", log.LstdFlags)
 	_, _, err = mergeVars("fixtures/gpte/OCP_CLIENTVM/.testloop.yaml", mergeStrategies)
 
-	if err != ErrorIncludeLoop {
+	if !errors.Is(err, ErrorIncludeLoop) {
 		t.Error("ErrorIncludeLoop expected, got", err)
 	}
 }
 
+func TestIncludeErrorChain(t *testing.T) {
+	initLoggers()
+	logErr = log.New(io.Discard, "!!! ", log.LstdFlags)
+	rootFlag = abs("fixtures")
+
+	_, _, err := mergeVars("fixtures/gpte/OCP_CLIENTVM/.testloop.yaml", mergeStrategies)
+	var includeErr *IncludeError
+	if !errors.As(err, &includeErr) {
+		t.Fatal("IncludeError expected, got", err)
+	}
+
+	expected := "include loop: /gpte/OCP_CLIENTVM/.testloop.yaml:2 -> /includes/loop1.yaml:2 -> /includes/loop2.yaml:2 -> /includes/loop1.yaml"
+	if err.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, err.Error())
+	}
+
+	rootFlag = abs("incorrect-fixtures")
+	_, _, err = mergeVars("incorrect-fixtures/test/TEST_MISSING_INCLUDE/dev.yaml", mergeStrategies)
+	if !errors.As(err, &includeErr) || !errors.Is(err, ErrorIncludeNotFound) {
+		t.Fatal("IncludeError with ErrorIncludeNotFound expected, got", err)
+	}
+
+	expectedChain := []IncludeFrame{
+		{Path: abs("incorrect-fixtures/test/TEST_MISSING_INCLUDE/dev.yaml"), Line: 3},
+		{Path: abs("incorrect-fixtures/includes/wrapper.yaml"), Line: 3},
+		{Path: abs("incorrect-fixtures/includes/missing.yaml")},
+	}
+	if !reflect.DeepEqual(includeErr.Chain, expectedChain) {
+		t.Error("expected chain", expectedChain, "got", includeErr.Chain)
+	}
+
+	// A misspelled parameter must not drop the include
+	_, _, err = mergeVars("incorrect-fixtures/test/TEST_INCLUDE_TYPO/dev.yaml", mergeStrategies)
+	if !errors.Is(err, ErrorIncludeSyntax) || !strings.Contains(err.Error(), "line 3") {
+		t.Error("ErrorIncludeSyntax expected on line 3, got", err)
+	}
+}
+
+func TestIncludeDiamond(t *testing.T) {
+	initLoggers()
+	rootFlag = abs("fixtures")
+	initConf(rootFlag)
+	initSchemaList()
+	initMergeStrategies()
+
+	merged, mergeList, err := mergeVars("fixtures/test/INCLUDE_DIAMOND/diamond.yaml", mergeStrategies)
+	if err != nil {
+		t.Fatal("diamond includes should not be reported as a loop:", err)
+	}
+
+	// base.yaml is merged once, at its first position
+	positions := map[string]int{}
+	for i, include := range mergeList {
+		if _, ok := positions[include.path]; ok {
+			t.Error(include.path, "is more than once in the merge list")
+		}
+		positions[include.path] = i
+	}
+
+	base := positions[abs("fixtures/includes/diamond/base.yaml")]
+	left := positions[abs("fixtures/includes/diamond/left.yaml")]
+	right := positions[abs("fixtures/includes/diamond/right.yaml")]
+	if !(base < left && left < right) {
+		t.Error("expected base.yaml, left.yaml, right.yaml order, got", base, left, right)
+	}
+
+	for k, v := range map[string]string{
+		"from_base":           "base",
+		"overridden_by_left":  "left",
+		"overridden_by_right": "right",
+		"from_diamond":        "diamond",
+	} {
+		if merged[k] != v {
+			t.Errorf("expected %s=%s, got %v", k, v, merged[k])
+		}
+	}
+}
+
+func TestIncludeGlobAndDirectory(t *testing.T) {
+	initLoggers()
+	rootFlag = abs("fixtures")
+	initConf(rootFlag)
+	initSchemaList()
+	initMergeStrategies()
+
+	testCases := []struct {
+		path     string
+		expected []string
+		last     string
+	}{
+		{
+			path: "fixtures/test/INCLUDE_GLOB/glob.yaml",
+			expected: []string{
+				"fixtures/includes/glob/a.yaml",
+				"fixtures/includes/glob/b.meta.yaml",
+				"fixtures/includes/glob/b.yaml",
+				"fixtures/test/INCLUDE_GLOB/glob.yaml",
+			},
+			last: "b",
+		},
+		{
+			path: "fixtures/test/INCLUDE_GLOB/directory.yaml",
+			expected: []string{
+				"fixtures/includes/glob/a.yaml",
+				"fixtures/includes/glob/b.meta.yaml",
+				"fixtures/includes/glob/b.yaml",
+				"fixtures/includes/glob/c.yml",
+				"fixtures/test/INCLUDE_GLOB/directory.yaml",
+			},
+			last: "c",
+		},
+	}
+
+	for _, tc := range testCases {
+		merged, mergeList, err := mergeVars(tc.path, mergeStrategies)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Skip common files
+		mergeList = mergeList[len(mergeList)-len(tc.expected):]
+		for i, include := range mergeList {
+			if include.path != abs(tc.expected[i]) {
+				t.Error(tc.path, "expected", tc.expected[i], "at position", i, "got", include.path)
+			}
+		}
+
+		if merged["last"] != tc.last {
+			t.Error(tc.path, "expected last =", tc.last, "got", merged["last"])
+		}
+	}
+
+	logErr = log.New(io.Discard, "!!! ", log.LstdFlags)
+	if _, _, err := mergeVars("fixtures/test/INCLUDE_GLOB/nomatch.yaml", mergeStrategies); !errors.Is(err, ErrorIncludeNotFound) {
+		t.Error("ErrorIncludeNotFound expected for a glob without match, got", err)
+	}
+}
+
+func TestIncludeOptional(t *testing.T) {
+	initLoggers()
+	rootFlag = abs("fixtures")
+	initConf(rootFlag)
+	initSchemaList()
+	initMergeStrategies()
+
+	p := "fixtures/test/INCLUDE_OPTIONAL/optional.yaml"
+	merged, mergeList, err := mergeVars(p, mergeStrategies)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if merged["from_override"] != "present" {
+		t.Error("expected from_override = present, got", merged["from_override"])
+	}
+
+	// Missing optional includes are kept in the merge list as related files
+	for _, related := range []string{
+		"fixtures/includes/optional/region-overrides.yaml",
+		"fixtures/includes/optional/missing.yaml",
+		"fixtures/includes/optional/missing/file.yaml",
+	} {
+		if !containsPath(mergeList, abs(related)) {
+			t.Error(related, "expected in the related files of", p)
+		}
+	}
+
+	if containsPath(mergeList, abs("fixtures/includes/other.yaml")) {
+		t.Error("fixtures/includes/other.yaml is not expected in the related files of", p)
+	}
+}
+
+func TestIncludeFragment(t *testing.T) {
+	initLoggers()
+	rootFlag = abs("fixtures")
+	initConf(rootFlag)
+	initSchemaList()
+	initMergeStrategies()
+
+	merged, mergeList, err := mergeVars("fixtures/test/INCLUDE_FRAGMENT/fragment.yaml", mergeStrategies)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both fragments of the same file are in the merge list
+	count := 0
+	for _, include := range mergeList {
+		if include.path == abs("fixtures/includes/fragment/clusters.yaml") {
+			count++
+		}
+	}
+	if count != 2 {
+		t.Error("expected clusters.yaml twice in the merge list, got", count)
+	}
+
+	if merged["workers"] != 5.0 || merged["instance_type"] != "m5.2xlarge" {
+		t.Error("expected the values of /ocp4/large, got", merged["workers"], merged["instance_type"])
+	}
+
+	if _, ok := merged["ocp4"]; ok {
+		t.Error("only the fragment is expected to be merged, got key ocp4")
+	}
+
+	logErr = log.New(io.Discard, "!!! ", log.LstdFlags)
+	for _, p := range []string{
+		"fixtures/test/INCLUDE_FRAGMENT/notdict.yaml",
+		"fixtures/test/INCLUDE_FRAGMENT/notfound.yaml",
+	} {
+		if _, _, err := mergeVars(p, mergeStrategies); !errors.Is(err, ErrorIncludeFragment) {
+			t.Error(p, "ErrorIncludeFragment expected, got", err)
+		}
+	}
+}
+
+func TestIncludeInto(t *testing.T) {
+	initLoggers()
+	rootFlag = abs("fixtures")
+	initConf(rootFlag)
+	initSchemaList()
+	initMergeStrategies()
+
+	merged, _, err := mergeVars("fixtures/test/INCLUDE_INTO/into.yaml", mergeStrategies)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pointer := range []string{
+		"/__meta__/shared_secrets/0/name",
+		"/agnosticv_meta/shared_secrets/0/name",
+		// Includes of a mounted file are mounted with it
+		"/__meta__/wrapper/shared_secrets/0/name",
+		"/__meta__/wrapper/nested/shared_secrets/0/name",
+	} {
+		if found, value, _, err := Get(merged, pointer); err != nil || !found || value != "gpte-sandbox" {
+			t.Error("expected", pointer, "= gpte-sandbox, got", value, err)
+		}
+	}
+
+	if found, value, _, err := Get(merged, "/cloud/aws/workers"); err != nil || !found || value != 2.0 {
+		t.Error("expected /cloud/aws/workers = 2, got", value, err)
+	}
+
+	if found, value, _, err := Get(merged, "/__meta__/wrapper/wrapped"); err != nil || !found || value != true {
+		t.Error("expected /__meta__/wrapper/wrapped = true, got", value, err)
+	}
+
+	for _, key := range []string{"shared_secrets", "nested", "wrapped"} {
+		if _, ok := merged[key]; ok {
+			t.Error(key, "is not expected at the top level")
+		}
+	}
+}
+
+func TestIncludePositionAfter(t *testing.T) {
+	initLoggers()
+	rootFlag = abs("fixtures")
+	initConf(rootFlag)
+	initSchemaList()
+	initMergeStrategies()
+
+	merged, mergeList, err := mergeVars("fixtures/test/INCLUDE_POSITION/after.yaml", mergeStrategies)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"fixtures/includes/position/base.yaml",
+		"fixtures/test/INCLUDE_POSITION/after.yaml",
+		"fixtures/includes/position/patch.yaml",
+		"fixtures/includes/position/overlay.yaml",
+	}
+
+	// Skip common files
+	mergeList = mergeList[len(mergeList)-len(expected):]
+	for i, include := range mergeList {
+		if include.path != abs(expected[i]) {
+			t.Error("expected", expected[i], "at position", i, "got", include.path)
+		}
+	}
+
+	if merged["value"] != "overlay" {
+		t.Error("expected value = overlay, got", merged["value"])
+	}
+
+	if merged["from_base"] != "base" || merged["from_patch"] != "patch" {
+		t.Error("expected from_base and from_patch, got", merged["from_base"], merged["from_patch"])
+	}
+}
+
+func TestIncludePositionAfterDuplicate(t *testing.T) {
+	initLoggers()
+	rootFlag = abs("fixtures")
+	initConf(rootFlag)
+	initSchemaList()
+	initMergeStrategies()
+
+	// base.yaml is included by the common file, and with position=after by the leaf
+	merged, mergeList, err := mergeVars("fixtures/test/INCLUDE_POSITION_COMMON/after.yaml", mergeStrategies)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"fixtures/test/INCLUDE_POSITION_COMMON/common.yaml",
+		"fixtures/test/INCLUDE_POSITION_COMMON/after.yaml",
+		"fixtures/includes/position/base.yaml",
+	}
+
+	// Skip the root common files
+	mergeList = mergeList[len(mergeList)-len(expected):]
+	for i, include := range mergeList {
+		if include.path != abs(expected[i]) {
+			t.Error("expected", expected[i], "at position", i, "got", include.path)
+		}
+	}
+
+	if merged["value"] != "base" {
+		t.Error("expected value = base, got", merged["value"])
+	}
+}
+
+func TestIncludeParams(t *testing.T) {
+	initLoggers()
+	rootFlag = abs("fixtures")
+	initConf(rootFlag)
+	initSchemaList()
+	initMergeStrategies()
+
+	merged, _, err := mergeVars("fixtures/test/INCLUDE_PARAMS/params.yaml", mergeStrategies)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		pointer  string
+		expected any
+	}{
+		{"/cluster_a/ocp_version", "4.14"},
+		{"/cluster_a/worker_instance_count", 3.0},
+		{"/cluster_a/cluster_name", "ocp-4.14"},
+		{"/cluster_a/deploy_command", "echo ${HOME}"},
+		{"/cluster_b/ocp_version", "4.15"},
+		{"/cluster_b/worker_instance_count", 5.0},
+	}
+
+	for _, tc := range testCases {
+		if found, value, _, err := Get(merged, tc.pointer); err != nil || !found || value != tc.expected {
+			t.Error("expected", tc.pointer, "=", tc.expected, "got", value, err)
+		}
+	}
+
+	logErr = log.New(io.Discard, "!!! ", log.LstdFlags)
+	for _, p := range []string{
+		"fixtures/test/INCLUDE_PARAMS/undefined.yaml",
+		"fixtures/test/INCLUDE_PARAMS/unset.yaml",
+	} {
+		if _, _, err := mergeVars(p, mergeStrategies); !errors.Is(err, ErrorIncludeUndefinedParam) {
+			t.Error(p, "ErrorIncludeUndefinedParam expected, got", err)
+		}
+	}
+}
+
+func TestIncludeKey(t *testing.T) {
+	initLoggers()
+	rootFlag = abs("fixtures")
+	initConf(rootFlag)
+	initSchemaList()
+	initMergeStrategies()
+
+	merged, mergeList, err := mergeVars("fixtures/test/INCLUDE_KEY/key.yaml", mergeStrategies)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Includes of the comment directive and of the key are in the order of their lines
+	expected := []string{
+		"fixtures/includes/position/base.yaml",
+		"fixtures/includes/glob/a.yaml",
+		"fixtures/includes/position/overlay.yaml",
+		"fixtures/includes/params/ocp-cluster.yaml",
+		"fixtures/includes/optional/missing.yaml",
+		"fixtures/test/INCLUDE_KEY/key.yaml",
+	}
+
+	// Skip common files
+	mergeList = mergeList[len(mergeList)-len(expected):]
+	for i, include := range mergeList {
+		if include.path != abs(expected[i]) {
+			t.Error("expected", expected[i], "at position", i, "got", include.path)
+		}
+	}
+
+	// recursive: false, patch.yaml is not included
+	if merged["value"] != "overlay" {
+		t.Error("expected value = overlay, got", merged["value"])
+	}
+
+	if found, value, _, err := Get(merged, "/cluster/ocp_version"); err != nil || !found || value != "4.14" {
+		t.Error("expected /cluster/ocp_version = 4.14, got", value, err)
+	}
+
+	if _, ok := merged[includeKey]; ok {
+		t.Error(includeKey, "is expected to be stripped from the merged output")
+	}
+
+	logErr = log.New(io.Discard, "!!! ", log.LstdFlags)
+	if _, _, err := mergeVars("fixtures/test/INCLUDE_KEY/invalid.yaml", mergeStrategies); !errors.Is(err, ErrorIncludeKey) {
+		t.Error("ErrorIncludeKey expected, got", err)
+	}
+}
+
+func TestOverlayRoot(t *testing.T) {
+	initLoggers()
+	rootFlag = abs("fixtures")
+	overlayRootFlag = abs("overlay-fixtures")
+	defer func() { overlayRootFlag = "" }()
+	initConf(rootFlag)
+	initSchemaList()
+	initMergeStrategies()
+
+	merged, mergeList, err := mergeVars("fixtures/test/OVERLAY/dev.yaml", mergeStrategies)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"fixtures/common.yaml",
+		"overlay-fixtures/common.yaml",
+		"fixtures/test/account.yaml",
+		"overlay-fixtures/test/OVERLAY/common.yaml",
+		"fixtures/includes/overlay/base.yaml",
+		"overlay-fixtures/includes/overlay/base.yaml",
+		"overlay-fixtures/includes/overlay/private.yaml",
+		"fixtures/test/OVERLAY/dev.yaml",
+		"overlay-fixtures/test/OVERLAY/dev.yaml",
+	}
+
+	if len(mergeList) != len(expected) {
+		t.Fatal("expected", len(expected), "files in the merge list, got", mergeList)
+	}
+	for i, include := range mergeList {
+		if include.path != abs(expected[i]) {
+			t.Error("expected", expected[i], "at position", i, "got", include.path)
+		}
+	}
+
+	testCases := []struct {
+		key      string
+		expected any
+	}{
+		{"foo", "from-overlay-common"},
+		{"from_overlay_dir_common", true},
+		{"from_base_include", true},
+		{"from_private", true},
+		// The leaf overrides the includes
+		{"value", "base-leaf"},
+		{"leaf", "overlay"},
+	}
+	for _, tc := range testCases {
+		if merged[tc.key] != tc.expected {
+			t.Error("expected", tc.key, "=", tc.expected, "got", merged[tc.key])
+		}
+	}
+
+	if len(localIncludes(mergeList)) != 4 {
+		t.Error("expected only the files of the root in the local includes, got", localIncludes(mergeList))
+	}
+}
+
+func TestCommonFiles(t *testing.T) {
+	initLoggers()
+	rootFlag = abs("fixtures")
+	initConf(rootFlag)
+	initSchemaList()
+	initMergeStrategies()
+	defer initConf(rootFlag)
+
+	var warnings bytes.Buffer
+	logErr = log.New(&warnings, "!!! ", 0)
+	warnedCommonDirs = map[string]bool{}
+
+	testCases := []struct {
+		commonFiles []string
+		expected    []string
+		level       string
+	}{
+		{
+			// Default: every common file of the directory is merged
+			commonFiles: nil,
+			expected: []string{
+				"fixtures/common.yaml",
+				"fixtures/test/account.yaml",
+				"fixtures/test/COMMON_FILES/account.yaml",
+				"fixtures/test/COMMON_FILES/common.yaml",
+				"fixtures/test/COMMON_FILES/common.yml",
+				"fixtures/test/COMMON_FILES/dev.yaml",
+			},
+			level: "common-yml",
+		},
+		{
+			commonFiles: []string{"common.yaml", "account.yaml"},
+			expected: []string{
+				"fixtures/common.yaml",
+				"fixtures/test/account.yaml",
+				"fixtures/test/COMMON_FILES/common.yaml",
+				"fixtures/test/COMMON_FILES/account.yaml",
+				"fixtures/test/COMMON_FILES/dev.yaml",
+			},
+			level: "account",
+		},
+	}
+
+	for _, tc := range testCases {
+		config.CommonFiles = tc.commonFiles
+
+		merged, mergeList, err := mergeVars("fixtures/test/COMMON_FILES/dev.yaml", mergeStrategies)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(mergeList) != len(tc.expected) {
+			t.Error(tc.commonFiles, "expected", len(tc.expected), "files in the merge list, got", mergeList)
+			continue
+		}
+		for i, include := range mergeList {
+			if include.path != abs(tc.expected[i]) {
+				t.Error(tc.commonFiles, "expected", tc.expected[i], "at position", i, "got", include.path)
+			}
+		}
+
+		if merged["level"] != tc.level {
+			t.Error(tc.commonFiles, "expected level =", tc.level, "got", merged["level"])
+		}
+	}
+
+	if !strings.Contains(warnings.String(), "both common.yaml and common.yml exist") {
+		t.Error("expected a warning for common.yaml and common.yml, got", warnings.String())
+	}
+}
+
 func TestIncludeRecursiveFalse(t *testing.T) {
 	initLoggers()
 	rootFlag = abs("fixtures")
@@ -645,6 +1574,30 @@ func TestIncludeCatalogItemWithCommonFiles(t *testing.T) {
 	}
 }
 
+func TestSplitMergeList(t *testing.T) {
+	mergeList := []Include{
+		{path: "/common.yaml"},
+		{path: "/item.yaml"},
+		{path: "/after.yaml"},
+	}
+
+	before, after, err := splitMergeList(mergeList, "/item.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(before) != 1 || before[0].path != "/common.yaml" {
+		t.Error("expected common.yaml before the item, got", before)
+	}
+	if len(after) != 1 || after[0].path != "/after.yaml" {
+		t.Error("expected after.yaml after the item, got", after)
+	}
+
+	// The whole merge list must not be dropped silently
+	if _, _, err := splitMergeList(mergeList, "/other/item.yaml"); !errors.Is(err, ErrorIncludeMergeList) {
+		t.Error("ErrorIncludeMergeList expected, got", err)
+	}
+}
+
 func TestMergeCommonFileWalksUpParents(t *testing.T) {
 	initLoggers()
 	rootFlag = abs("fixtures")
@@ -897,6 +1850,20 @@ func TestFindRoot(t *testing.T) {
 	}
 }
 
+func TestFindRootExportedTree(t *testing.T) {
+	// Tree without .git, top-most .agnosticv.yaml is the root
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{
+		".agnosticv.yaml":     "---\n",
+		"sub/.agnosticv.yaml": "---\n",
+		"sub/item/dev.yaml":   "---\n",
+	})
+
+	if result := findRoot(filepath.Join(dir, "sub/item/dev.yaml")); result != dir {
+		t.Error("with exported tree:", result, "!=", dir)
+	}
+}
+
 func TestLoadInto(t *testing.T) {
 	rootFlag = abs("fixtures")
 	initConf(rootFlag)
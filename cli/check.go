@@ -0,0 +1,204 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var stagedFlag bool
+
+func parseCheckFlags(args []string, output io.Writer) controlFlow {
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.BoolVar(&stagedFlag, "staged", false, `Check only the catalog items affected by the changes staged in git, using the staged content instead of the working tree.
+Use it in a git pre-commit hook.`)
+	flags.StringVar(&rootFlag, "root", "", "The top directory of the agnosticv files. By default, the root is discovered from the current directory.")
+	flags.StringVar(&gitDirFlag, "git-dir", os.Getenv("GIT_DIR"), "Path to the git repository. Default is the value of the GIT_DIR environment variable.")
+	flags.StringVar(&workTreeFlag, "work-tree", os.Getenv("GIT_WORK_TREE"), "The top directory of the working tree, to use with --git-dir.")
+	flags.BoolVar(&strictFlag, "strict", false, "Fail on duplicate keys in YAML files, instead of printing a warning.")
+	flags.BoolVar(&debugFlag, "debug", false, "Debug mode")
+
+	if err := flags.Parse(args[1:]); err != nil {
+		flags.PrintDefaults()
+		return controlFlow{true, 2}
+	}
+
+	if flags.NArg() > 0 {
+		fmt.Fprintln(output, "Unexpected arguments:", flags.Args())
+		return controlFlow{true, 2}
+	}
+
+	if gitDirFlag != "" {
+		gitDirFlag = abs(gitDirFlag)
+	}
+
+	if workTreeFlag != "" {
+		workTreeFlag = abs(workTreeFlag)
+		if rootFlag == "" {
+			rootFlag = workTreeFlag
+		}
+	}
+
+	if rootFlag != "" {
+		if !fileExists(rootFlag) {
+			fmt.Fprintln(output, "Error: root", rootFlag, "does not exist")
+			return controlFlow{true, 1}
+		}
+		rootFlag = abs(rootFlag)
+	} else {
+		workdir, err := os.Getwd()
+		if err != nil {
+			fmt.Fprintln(output, "Error:", err)
+			return controlFlow{true, 1}
+		}
+		rootFlag = findRoot(workdir)
+	}
+
+	if stagedFlag && !isRepo(rootFlag) {
+		fmt.Fprintln(output, "Error: --staged needs a git repository,", rootFlag, "is not in a git repository")
+		return controlFlow{true, 2}
+	}
+
+	if debugFlag {
+		logDebug = log.New(os.Stdout, "(d) ", log.LstdFlags)
+	}
+
+	return controlFlow{false, 0}
+}
+
+// runCheck merges and validates catalog items against the schemas, and reports all errors.
+// With --staged, only the catalog items affected by the staged changes are checked,
+// using the content of the git index.
+// Returns the exit code.
+func runCheck(args []string, output io.Writer) int {
+	if flow := parseCheckFlags(args, output); flow.stop {
+		return flow.rc
+	}
+
+	// Git information is not needed to validate catalog items
+	gitFlag = false
+
+	var affected []string
+	if stagedFlag {
+		_, errLookPath := exec.LookPath("git")
+
+		var staged []string
+		if errLookPath != nil {
+			staged = findStagedFiles(rootFlag)
+		} else {
+			staged = findStagedFilesCmd(rootFlag)
+		}
+
+		if len(staged) == 0 {
+			fmt.Fprintln(output, "No staged changes.")
+			return 0
+		}
+
+		// Check the staged content, exported from the index
+		exportDir, err := os.MkdirTemp("", "agnosticv-staged-")
+		if err != nil {
+			fmt.Fprintln(output, "Error:", err)
+			return 1
+		}
+		defer os.RemoveAll(exportDir)
+
+		top := worktreeRoot(rootFlag)
+		if errLookPath != nil {
+			exportIndex(rootFlag, exportDir)
+		} else {
+			exportIndexCmd(rootFlag, exportDir)
+		}
+
+		relRoot, err := filepath.Rel(top, rootFlag)
+		if err != nil {
+			fmt.Fprintln(output, "Error:", err)
+			return 1
+		}
+		rootFlag = filepath.Join(exportDir, relRoot)
+		if !fileExists(rootFlag) {
+			fmt.Fprintln(output, "No staged files in", relRoot)
+			return 0
+		}
+
+		affected = []string{}
+		for _, f := range staged {
+			p := filepath.Join(exportDir, filepath.FromSlash(f))
+			if !isRoot(rootFlag, p) {
+				continue
+			}
+
+			// Changes in configuration, ignore files or schemas affect all catalog items
+			rel := p[len(rootFlag):]
+			if filepath.Base(rel) == configFileName || filepath.Base(rel) == ignoreFileName || strings.HasPrefix(rel, "/.schemas/") {
+				affected = nil
+				break
+			}
+
+			affected = append(affected, p)
+		}
+	}
+
+	if problems := checkConfig(); len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Fprintln(output, problem)
+		}
+		fmt.Fprintf(output, "%d problems found in the configuration.\n", len(problems))
+		return 1
+	}
+
+	initMergeStrategies()
+
+	catalogItems, err := findCatalogItems(rootFlag, []string{}, []string{}, []string{})
+	if err != nil {
+		fmt.Fprintln(output, "Error:", err)
+		return 1
+	}
+
+	checked := 0
+	failed := 0
+	for _, catalogItem := range catalogItems {
+		p := filepath.Join(rootFlag, catalogItem)
+
+		if affected != nil {
+			mergeList, err := getMergeList(p)
+			if err == nil && !containsAnyPath(extendMergeListWithRelated(p, mergeList), affected) {
+				continue
+			}
+		}
+
+		checked++
+		merged, _, err := mergeVars(p, mergeStrategies)
+		if err != nil {
+			failed++
+			fmt.Fprintf(output, "%s - %v\n", catalogItem, err)
+			continue
+		}
+
+		if err := validateAgainstSchemas(catalogItem, merged); err != nil {
+			failed++
+			fmt.Fprintln(output, err)
+		}
+	}
+
+	fmt.Fprintf(output, "%d catalog items checked, %d failed.\n", checked, failed)
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func containsAnyPath(l []Include, paths []string) bool {
+	for _, p := range paths {
+		if containsPath(l, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	git "github.com/go-git/go-git/v5"
+)
+
+func TestCheckStaged(t *testing.T) {
+	initLoggers()
+	prevStaged, prevGit, prevRoot := stagedFlag, gitFlag, rootFlag
+	defer func() {
+		stagedFlag = prevStaged
+		gitFlag = prevGit
+		rootFlag = prevRoot
+		initConf(rootFlag)
+		schemas = nil
+		initSchemaList()
+		initMergeStrategies()
+	}()
+
+	dir := initTestRepo(t, map[string]string{
+		"common.yaml":           "purpose: test\n",
+		"includes/shared.yaml":  "shared: ok\n",
+		"a/dev.yaml":            "#include /includes/shared.yaml\nfoo: a\n",
+		"b/dev.yaml":            "foo: b\n",
+		".schemas/schema.yaml":  "type: object\nproperties:\n  shared:\n    type: string\n",
+		"includes/unused.yaml":  "unused: true\n",
+		"c/description.adoc":    "description\n",
+		"c/prod.yaml":           "foo: c\n",
+		"a/description.adoc":    "description\n",
+		"b/nested/common.yaml":  "nested: true\n",
+		"b/nested/prod.yaml":    "foo: nested\n",
+		"includes/another.yaml": "another: true\n",
+	})
+
+	// Stage an invalid change in the include, then fix it in the working tree only
+	shared := filepath.Join(dir, "includes/shared.yaml")
+	if err := os.WriteFile(shared, []byte("shared: [1, 2]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, _ := repo.Worktree()
+	if _, err := wt.Add("includes/shared.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(shared, []byte("shared: fixed\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, export := range []string{"cmd", "go-git"} {
+		var output bytes.Buffer
+		rootFlag = ""
+		if export == "go-git" {
+			// Hide git from PATH to use pure-go
+			t.Setenv("PATH", "")
+		}
+
+		rc := runCheck([]string{"check", "--staged", "--root", dir}, &output)
+		if rc != 1 {
+			t.Error(export, "expected rc 1, got", rc, output.String())
+		}
+		if !strings.Contains(output.String(), "a/dev.yaml") {
+			t.Error(export, "a/dev.yaml should be reported:", output.String())
+		}
+		if !strings.Contains(output.String(), "1 catalog items checked, 1 failed.") {
+			t.Error(export, "only a/dev.yaml should be checked:", output.String())
+		}
+	}
+
+	// A staged ignore file, in any directory, affects all catalog items
+	writeTestFiles(t, dir, map[string]string{"b/" + ignoreFileName: "*.tmp\n"})
+	if _, err := wt.Add("b/" + ignoreFileName); err != nil {
+		t.Fatal(err)
+	}
+	var ignoreOutput bytes.Buffer
+	rootFlag = ""
+	if rc := runCheck([]string{"check", "--staged", "--root", dir}, &ignoreOutput); rc != 1 {
+		t.Error("expected rc 1, got", rc, ignoreOutput.String())
+	}
+	if !strings.Contains(ignoreOutput.String(), "4 catalog items checked, 1 failed.") {
+		t.Error("all catalog items should be checked with a staged ignore file:", ignoreOutput.String())
+	}
+
+	// Working tree is valid
+	var output bytes.Buffer
+	stagedFlag = false
+	rootFlag = ""
+	if rc := runCheck([]string{"check", "--root", dir}, &output); rc != 0 {
+		t.Error("expected rc 0 when checking the working tree, got", rc, output.String())
+	}
+	if !strings.Contains(output.String(), "4 catalog items checked, 0 failed.") {
+		t.Error("all catalog items should be checked:", output.String())
+	}
+}
+
+func TestConfigCheck(t *testing.T) {
+	initLoggers()
+	defer func() {
+		rootFlag = abs("fixtures")
+		initConf(rootFlag)
+	}()
+
+	var output bytes.Buffer
+	if rc := runConfig([]string{"config", "check", "--root", "fixtures"}, &output); rc != 0 {
+		t.Error("fixtures configuration should be valid, got", rc, output.String())
+	}
+
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{
+		configFileName: `related_file:
+  - typo.yaml
+related_files_v2:
+  - file: description.adoc
+    load_into: /__meta__/catalog
+    content_key: description
+  - file: description.html
+    load_into: /__meta__/catalog
+    content_key: description
+  - file: message.j2
+    load_into: /__meta__/message
+  - file: labels.yaml
+    load_into: /labels
+    content_key: content
+merge_strategies:
+  - path: /tags
+    strategy: append
+`,
+		".schemas/schema.yaml":   "type: object\nx-merge:\n  - path: /labels/content\n    strategy: merge\n",
+		"team/" + configFileName: "keyring: 42\ncommon_files:\n  - common\n",
+	})
+
+	// All problems of the schema are reported at once
+	output.Reset()
+	rootFlag = ""
+	if rc := runConfig([]string{"config", "check", "--root", dir}, &output); rc != 1 {
+		t.Error("expected rc 1, got", rc)
+	}
+	for _, expected := range []string{
+		`property "related_file" is unsupported`,
+		"/merge_strategies/0/strategy",
+		"/related_files_v2/2: load_into needs a content_key",
+		"team/.agnosticv.yaml: /keyring",
+		// Root only keys are not read from a subdirectory
+		"team/.agnosticv.yaml: /common_files: only read from the .agnosticv.yaml file at the root",
+		"6 problems found.",
+	} {
+		if !strings.Contains(output.String(), expected) {
+			t.Error("expected", expected, "in", output.String())
+		}
+	}
+
+	// Collisions are reported once the files are valid
+	if err := os.WriteFile(filepath.Join(dir, configFileName), []byte(`related_files_v2:
+  - file: description.adoc
+    load_into: /__meta__/catalog
+    content_key: description
+  - file: description.html
+    load_into: /__meta__/catalog
+    content_key: description
+  - file: labels.yaml
+    load_into: /labels
+    content_key: content
+merge_strategies:
+  - path: /__meta__/catalog
+    strategy: overwrite
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "team", configFileName)); err != nil {
+		t.Fatal(err)
+	}
+
+	output.Reset()
+	rootFlag = ""
+	if rc := runConfig([]string{"config", "check", "--root", dir}, &output); rc != 1 {
+		t.Error("expected rc 1, got", rc)
+	}
+	for _, expected := range []string{
+		"related files description.adoc and description.html are both loaded into /__meta__/catalog/description",
+		"related file labels.yaml is loaded into /labels/content, which collides with merge strategy merge on /labels/content",
+		// Overwriting a parent of the target drops the loaded content
+		"related file description.adoc is loaded into /__meta__/catalog/description, which collides with merge strategy overwrite on /__meta__/catalog",
+		"3 problems found.",
+	} {
+		if !strings.Contains(output.String(), expected) {
+			t.Error("expected", expected, "in", output.String())
+		}
+	}
+
+	// Paths are relative to the root
+	if !strings.HasPrefix(output.String(), configFileName+": ") {
+		t.Error("expected a path relative to the root, got", output.String())
+	}
+
+	// At startup, only the configuration files that apply to the item are validated
+	rootFlag = abs("fixtures")
+	if got := configFilesFor(abs("fixtures/test/MULTI_DOCUMENT")); !reflect.DeepEqual(got, []string{
+		abs("fixtures/" + configFileName),
+		abs("fixtures/test/MULTI_DOCUMENT/" + configFileName),
+	}) {
+		t.Error("unexpected configuration files", got)
+	}
+	if got := configFilesFor(abs("fixtures/test/BABYLON_EMPTY_CONFIG")); !reflect.DeepEqual(got, []string{abs("fixtures/" + configFileName)}) {
+		t.Error("unexpected configuration files", got)
+	}
+
+	// With --list, the configuration files of the subdirectories are validated too
+	listDir := t.TempDir()
+	writeTestFiles(t, listDir, map[string]string{
+		"a/" + configFileName: "merge_strategies: []\n",
+		"b/" + configFileName: "related_file:\n  - typo.yaml\n",
+	})
+	rootFlag = listDir
+	paths, err := configFilesUnder(listDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(paths, []string{
+		filepath.Join(listDir, "a", configFileName),
+		filepath.Join(listDir, "b", configFileName),
+	}) {
+		t.Error("unexpected configuration files", paths)
+	}
+	if problems := checkConfigFiles(paths); len(problems) != 1 || !strings.Contains(problems[0], "b/"+configFileName) {
+		t.Error("expected a problem in b/"+configFileName+", got", problems)
+	}
+	if got, _ := configFilesUnder(filepath.Join(listDir, "a")); !reflect.DeepEqual(got, []string{filepath.Join(listDir, "a", configFileName)}) {
+		t.Error("unexpected configuration files", got)
+	}
+
+	// check fails on an invalid configuration
+	output.Reset()
+	rootFlag = ""
+	if rc := runCheck([]string{"check", "--root", dir}, &output); rc != 1 {
+		t.Error("expected rc 1, got", rc, output.String())
+	}
+}
@@ -20,14 +20,39 @@ type Config struct {
 	RelatedFiles   []string      `json:"related_files"`
 	RelatedFilesV2 []RelatedFile `json:"related_files_v2"`
 
+	// Keyring to verify signatures of commits, relative to the root of the repo.
+	// Either an armored GPG keyring or an SSH allowed signers file.
+	Keyring string `json:"keyring"`
+
+	// Directories, relative to the root of the repo, where bare include
+	// names are searched, in order, after the directory of the including file.
+	IncludePaths []string `json:"include_paths"`
+
+	// Other repositories to include files from, with #include repo=NAME@REF.
+	// Maps a name to a local path, relative to the root of the repo, or a URL.
+	Repositories map[string]string `json:"repositories"`
+
+	// Names of the common files, in merge order: in a directory, a common
+	// file overrides the common files listed before it.
+	CommonFiles []string `json:"common_files"`
+
+	// Merge strategies, in addition to the ones defined in the schemas.
+	MergeStrategies []MergeStrategy `json:"merge_strategies"`
+
+	// What to do with files containing several YAML documents:
+	// "error" (default) or "merge" the documents in order.
+	MultiDocument string `json:"multi_document"`
+
 	// Plumbing variable to know when config was loaded from disk.
 	initialized bool
 }
 
+const configFileName = ".agnosticv.yaml"
+
 func getConf(root string) Config {
 	c := Config{}
 
-	path := filepath.Join(root, ".agnosticv.yaml")
+	path := filepath.Join(root, configFileName)
 
 	if !fileExists(path) {
 		return c
@@ -50,6 +75,66 @@ func getConf(root string) Config {
 
 var config Config
 
+// configCache caches the layered configuration per directory, see configFor()
+var configCache = map[string]Config{}
+
 func initConf(root string) {
 	config = getConf(root)
+	configCache = map[string]Config{}
+}
+
+// configFor returns the configuration that applies to the files in dir:
+// the configuration of the root, layered with the .agnosticv.yaml files
+// of the subdirectories down to dir.
+// The lists of related files, include paths and merge strategies of a
+// subdirectory are appended to the ones of its parents, multi_document overrides it.
+// keyring, repositories and common_files are only read from the root.
+func configFor(dir string) Config {
+	if rootFlag == "" || dir == rootFlag || !isRoot(rootFlag, dir) {
+		return config
+	}
+
+	if c, ok := configCache[dir]; ok {
+		return c
+	}
+
+	c := configFor(filepath.Dir(dir))
+	if fileExists(filepath.Join(dir, configFileName)) {
+		logDebug.Println("layering configuration", filepath.Join(dir, configFileName))
+		c = layerConf(c, getConf(dir))
+	}
+
+	configCache[dir] = c
+	return c
+}
+
+// layerConf returns the configuration parent with the settings of child appended.
+func layerConf(parent Config, child Config) Config {
+	c := parent
+	// Copy the lists so the parent configuration is never modified
+	c.RelatedFiles = append(append([]string{}, parent.RelatedFiles...), child.RelatedFiles...)
+	c.RelatedFilesV2 = append(append([]RelatedFile{}, parent.RelatedFilesV2...), child.RelatedFilesV2...)
+	c.IncludePaths = append(append([]string{}, parent.IncludePaths...), child.IncludePaths...)
+	c.MergeStrategies = append(append([]MergeStrategy{}, parent.MergeStrategies...), child.MergeStrategies...)
+	if child.MultiDocument != "" {
+		c.MultiDocument = child.MultiDocument
+	}
+	c.initialized = parent.initialized || child.initialized
+
+	return c
+}
+
+// keyringPath returns the keyring to use to verify the signature of commits,
+// or the empty string "" if none is configured.
+// The --keyring flag takes precedence over the configuration file.
+func keyringPath() string {
+	if keyringFlag != "" {
+		return keyringFlag
+	}
+
+	if config.Keyring != "" {
+		return filepath.Join(rootFlag, filepath.Clean(config.Keyring))
+	}
+
+	return ""
 }
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	jsonyaml "github.com/ghodss/yaml"
+	"github.com/go-openapi/jsonpointer"
+)
+
+// configSchema is the OpenAPI schema of the .agnosticv.yaml configuration files.
+// It is printed by 'agnosticv config schema'.
+var configSchema string = `
+type: object
+additionalProperties: false
+properties:
+  related_files:
+    description: >-
+      Files in the same directory as a catalog item that are related to it.
+    type: array
+    items:
+      type: string
+  related_files_v2:
+    description: >-
+      Files in the same directory as a catalog item that are related to it,
+      optionally loaded into the merged vars.
+    type: array
+    items:
+      type: object
+      additionalProperties: false
+      required:
+        - file
+      properties:
+        file:
+          type: string
+          minLength: 1
+        load_into:
+          description: JSON Pointer of the dictionary to load the file into.
+          type: string
+          pattern: ^/
+        content_key:
+          description: Key of the content of the file in the load_into dictionary.
+          type: string
+          minLength: 1
+        set:
+          description: Other keys to set in the load_into dictionary.
+          type: object
+  keyring:
+    description: >-
+      Keyring to verify the signatures of commits, from the top of the repository.
+    type: string
+  include_paths:
+    description: Directories where bare include names are searched.
+    type: array
+    items:
+      type: string
+  repositories:
+    description: Other repositories to include files from, by name.
+    type: object
+    additionalProperties:
+      type: string
+  common_files:
+    description: Names of the common files, in merge order.
+    type: array
+    items:
+      type: string
+  merge_strategies:
+    description: Merge strategies, in addition to the x-merge of the schemas.
+    type: array
+    items:
+      type: object
+      additionalProperties: false
+      required:
+        - path
+        - strategy
+      properties:
+        path:
+          type: string
+          pattern: ^/
+        strategy:
+          type: string
+          enum:
+            - overwrite
+            - merge
+            - merge-no-append
+            - strategic-merge
+  multi_document:
+    description: What to do with files containing several YAML documents.
+    type: string
+    enum:
+      - error
+      - merge
+`
+
+// ErrorConfig happens when the configuration files are not valid
+var ErrorConfig = errors.New("invalid configuration")
+
+// runConfig runs the 'config' subcommand.
+// Returns the exit code.
+func runConfig(args []string, output io.Writer) int {
+	if len(args) < 2 || (args[1] != "check" && args[1] != "schema") {
+		fmt.Fprintln(output, "Usage: agnosticv config check [--root DIR] | agnosticv config schema")
+		return 2
+	}
+
+	if args[1] == "schema" {
+		fmt.Fprint(output, strings.TrimPrefix(configSchema, "\n"))
+		return 0
+	}
+
+	flags := flag.NewFlagSet(args[0]+" "+args[1], flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.StringVar(&rootFlag, "root", "", "The top directory of the agnosticv files. By default, the root is discovered from the current directory.")
+	flags.BoolVar(&debugFlag, "debug", false, "Debug mode")
+
+	if err := flags.Parse(args[2:]); err != nil {
+		flags.PrintDefaults()
+		return 2
+	}
+
+	if flags.NArg() > 0 {
+		fmt.Fprintln(output, "Unexpected arguments:", flags.Args())
+		return 2
+	}
+
+	if rootFlag != "" {
+		if !fileExists(rootFlag) {
+			fmt.Fprintln(output, "Error: root", rootFlag, "does not exist")
+			return 1
+		}
+		rootFlag = abs(rootFlag)
+	} else {
+		workdir, err := os.Getwd()
+		if err != nil {
+			fmt.Fprintln(output, "Error:", err)
+			return 1
+		}
+		rootFlag = findRoot(workdir)
+	}
+
+	if debugFlag {
+		logDebug = log.New(os.Stdout, "(d) ", log.LstdFlags)
+	}
+
+	problems := checkConfig()
+	for _, problem := range problems {
+		fmt.Fprintln(output, problem)
+	}
+
+	if len(problems) > 0 {
+		fmt.Fprintf(output, "%d problems found.\n", len(problems))
+		return 1
+	}
+
+	fmt.Fprintln(output, "Configuration is valid.")
+	return 0
+}
+
+// exitOnInvalidConfig prints the problems of the configuration files paths
+// and exits if there are any. It runs before the configuration is loaded,
+// and loads it with the schemas.
+func exitOnInvalidConfig(paths []string) {
+	problems := checkConfigFiles(paths)
+	if len(problems) == 0 {
+		return
+	}
+
+	for _, problem := range problems {
+		logErr.Println(problem)
+	}
+	logErr.Fatalf("%v: %d problems found, see 'agnosticv config check'", ErrorConfig, len(problems))
+}
+
+// findConfigFiles returns the configuration files in root and its subdirectories.
+func findConfigFiles(root string) ([]string, error) {
+	result := []string{}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			// Skip hidden directories, like .git
+			if p != root && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if d.Name() == configFileName {
+			result = append(result, p)
+		}
+		return nil
+	})
+
+	return result, err
+}
+
+// configFilesFor returns the configuration files that apply to the files in
+// dir, from the root down to dir.
+func configFilesFor(dir string) []string {
+	result := []string{}
+	for d := dir; isRoot(rootFlag, d); d = filepath.Dir(d) {
+		if p := filepath.Join(d, configFileName); fileExists(p) {
+			result = append([]string{p}, result...)
+		}
+		if d == rootFlag || d == filepath.Dir(d) {
+			break
+		}
+	}
+	return result
+}
+
+// configFilesUnder returns the configuration files that apply to dir and
+// to all its subdirectories: the ones from the root down to dir, then the
+// ones below dir.
+func configFilesUnder(dir string) ([]string, error) {
+	below, err := findConfigFiles(dir)
+	if err != nil {
+		return []string{}, err
+	}
+
+	result := configFilesFor(dir)
+	done := map[string]bool{}
+	for _, p := range result {
+		done[p] = true
+	}
+	for _, p := range below {
+		if !done[p] {
+			result = append(result, p)
+		}
+	}
+	return result, nil
+}
+
+// checkConfig validates all the configuration files of the root and returns all the problems found.
+// When they are valid, the configuration and the schemas are loaded.
+func checkConfig() []string {
+	paths, err := findConfigFiles(rootFlag)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	return checkConfigFiles(paths)
+}
+
+// checkConfigFiles validates the configuration files paths and returns all the problems found.
+// When they are valid, the configuration and the schemas are loaded.
+func checkConfigFiles(paths []string) []string {
+	schema := openapi3.NewSchema()
+	if err := jsonyaml.Unmarshal([]byte(configSchema), schema); err != nil {
+		logErr.Fatalf("error loading the configuration schema: %v", err)
+	}
+
+	problems := []string{}
+	for _, p := range paths {
+		problems = append(problems, checkConfigFile(p, schema)...)
+	}
+
+	// Collisions are checked on the layered configuration, so only when all files are valid
+	if len(problems) > 0 {
+		return problems
+	}
+
+	initConf(rootFlag)
+
+	xMerge := []MergeStrategy{}
+	if schemaList, err := getSchemaList(); err == nil {
+		schemas = schemaList
+		for _, s := range schemaList {
+			xMerge = append(xMerge, s.schema.XMerge...)
+		}
+	} else {
+		problems = append(problems, fmt.Sprintf("cannot read schemas: %v", err))
+	}
+
+	// The configuration of a subdirectory includes the one of its parents,
+	// report each collision only once, for the first file where it appears
+	seen := map[string]bool{}
+	for _, p := range paths {
+		for _, problem := range checkConfigCollisions(filepath.Dir(p), xMerge) {
+			if !seen[problem] {
+				seen[problem] = true
+				problems = append(problems, fmt.Sprintf("%s: %s", configDisplayPath(p), problem))
+			}
+		}
+	}
+
+	return problems
+}
+
+// checkConfigFile validates the configuration file p against schema.
+func checkConfigFile(p string, schema *openapi3.Schema) []string {
+	display := configDisplayPath(p)
+	content, err := os.ReadFile(p)
+	if err != nil {
+		return []string{fmt.Sprintf("%s: %v", display, err)}
+	}
+
+	data, err := jsonyaml.YAMLToJSON(content)
+	if err != nil {
+		return []string{fmt.Sprintf("%s: %v", display, err)}
+	}
+
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return []string{fmt.Sprintf("%s: %v", display, err)}
+	}
+	if value == nil {
+		// Empty file
+		return []string{}
+	}
+
+	problems := []string{}
+	for _, err := range flattenSchemaErrors(schema.VisitJSON(value, openapi3.MultiErrors())) {
+		var schemaError *openapi3.SchemaError
+		if errors.As(err, &schemaError) {
+			problems = append(problems, fmt.Sprintf("%s: /%s: %s", display, strings.Join(schemaError.JSONPointer(), "/"), schemaError.Reason))
+			continue
+		}
+		problems = append(problems, fmt.Sprintf("%s: %v", display, err))
+	}
+	sort.Strings(problems)
+
+	// Content key is only needed to load the file
+	if m, ok := value.(map[string]any); ok {
+		if related, ok := m["related_files_v2"].([]any); ok {
+			for i, el := range related {
+				relatedFile, ok := el.(map[string]any)
+				if !ok {
+					continue
+				}
+				if _, ok := relatedFile["load_into"]; !ok {
+					continue
+				}
+				if _, ok := relatedFile["content_key"]; !ok {
+					problems = append(problems, fmt.Sprintf("%s: /related_files_v2/%d: load_into needs a content_key", display, i))
+				}
+			}
+		}
+
+		// Those keys are only read from the root configuration
+		if filepath.Dir(p) != filepath.Clean(rootFlag) {
+			for _, key := range []string{"keyring", "repositories", "common_files"} {
+				if _, ok := m[key]; ok {
+					problems = append(problems, fmt.Sprintf("%s: /%s: only read from the %s file at the root", display, key, configFileName))
+				}
+			}
+		}
+	}
+
+	return problems
+}
+
+// configDisplayPath returns the configuration file p relative to the root.
+func configDisplayPath(p string) string {
+	if rel, err := filepath.Rel(rootFlag, p); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel
+	}
+	return p
+}
+
+// flattenSchemaErrors returns the errors in err, flattening the nested multi errors.
+func flattenSchemaErrors(err error) []error {
+	if err == nil {
+		return []error{}
+	}
+
+	var multiError openapi3.MultiError
+	if !errors.As(err, &multiError) {
+		return []error{err}
+	}
+
+	result := []error{}
+	for _, e := range multiError {
+		result = append(result, flattenSchemaErrors(e)...)
+	}
+	return result
+}
+
+// checkConfigCollisions returns the related files that load their content
+// into the same path, or into a path that has a merge strategy, in the
+// layered configuration of dir. A merge strategy on a parent of the path
+// collides only if it overwrites, the other strategies keep the loaded key.
+func checkConfigCollisions(dir string, xMerge []MergeStrategy) []string {
+	c := configFor(dir)
+	problems := []string{}
+
+	// Paths written by related files, to the related file writing them
+	written := map[string]string{}
+	for _, related := range c.RelatedFilesV2 {
+		if related.LoadInto == "" {
+			continue
+		}
+
+		keys := []string{related.ContentKey}
+		for k := range related.Set {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			target := related.LoadInto + "/" + jsonpointer.Escape(k)
+			if other, ok := written[target]; ok && other != related.File {
+				problems = append(problems, fmt.Sprintf("related files %s and %s are both loaded into %s", other, related.File, target))
+				continue
+			}
+			written[target] = related.File
+
+			for _, strategy := range append(xMerge, c.MergeStrategies...) {
+				if strategy.Path == target || isPointerPrefix(target, strategy.Path) ||
+					(strategy.Strategy == "overwrite" && isPointerPrefix(strategy.Path, target)) {
+					problems = append(problems, fmt.Sprintf("related file %s is loaded into %s, which collides with merge strategy %s on %s", related.File, target, strategy.Strategy, strategy.Path))
+				}
+			}
+		}
+	}
+
+	return problems
+}
+
+// isPointerPrefix returns true if the JSON Pointer p is inside the JSON Pointer prefix.
+func isPointerPrefix(prefix string, p string) bool {
+	return strings.HasPrefix(p, strings.TrimSuffix(prefix, "/")+"/")
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// multiDocumentMerge is the value of multi_document in the configuration
+// file to merge the documents of a file in order, instead of failing.
+const multiDocumentMerge = "merge"
+
+// ErrorMultiDocument happens when a file contains several YAML documents
+// and multi_document is not set to merge
+var ErrorMultiDocument = errors.New("file contains several YAML documents")
+
+// yamlDocument is a YAML document of a file, decoded once for the
+// duplicate keys, the value tags and the merge
+type yamlDocument struct {
+	node    *yamlv3.Node // nil if the file cannot be decoded
+	content []byte       // nil if the document is encoded from node
+}
+
+// encode returns the content of the document, encoded from its node if needed.
+func (document yamlDocument) encode() ([]byte, error) {
+	if document.content != nil {
+		return document.content, nil
+	}
+	return yamlv3.Marshal(document.node)
+}
+
+// splitDocuments returns the YAML documents of content.
+// Empty documents, ex: after a trailing ---, are dropped.
+// If content has a single document, its content is kept as is.
+func splitDocuments(content []byte) ([]yamlDocument, error) {
+	decoder := yamlv3.NewDecoder(bytes.NewReader(content))
+	nodes := []*yamlv3.Node{}
+	for {
+		node := &yamlv3.Node{}
+		if err := decoder.Decode(node); err != nil {
+			if err == io.EOF {
+				break
+			}
+			if bytes.Contains(content, []byte("---")) || hasTags(content) {
+				// The documents cannot be told apart, never merge only the first one.
+				// Tags are resolved on the nodes, never merge them unresolved.
+				return []yamlDocument{}, err
+			}
+			// Let the parser of the merge report the error
+			logDebug.Println("cannot decode documents:", err)
+			return []yamlDocument{{content: content}}, nil
+		}
+
+		if len(node.Content) == 0 || (node.Content[0].Kind == yamlv3.ScalarNode && node.Content[0].Tag == "!!null") {
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+
+	switch len(nodes) {
+	case 0:
+		return []yamlDocument{{content: content}}, nil
+	case 1:
+		return []yamlDocument{{node: nodes[0], content: content}}, nil
+	}
+
+	result := []yamlDocument{}
+	for _, node := range nodes {
+		result = append(result, yamlDocument{node: node})
+	}
+	return result, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// ErrorDuplicateKey happens with --strict when a mapping has the same key twice
+var ErrorDuplicateKey = errors.New("duplicate key")
+
+// duplicateKey is a key defined twice in the same mapping
+type duplicateKey struct {
+	key       string
+	line      int // line of the duplicate
+	firstLine int // line where the key is first defined
+}
+
+// warnedDuplicateKeys records the files with duplicate keys already reported.
+var warnedDuplicateKeys = map[string]bool{}
+
+// findDuplicateKeys returns the duplicate keys in all the YAML documents of a file.
+// A YAML parser would silently keep one of the values.
+func findDuplicateKeys(documents []yamlDocument) []duplicateKey {
+	result := []duplicateKey{}
+	for _, document := range documents {
+		// Syntax errors are reported by the parser of the merge
+		if document.node != nil {
+			result = append(result, findNodeDuplicateKeys(document.node)...)
+		}
+	}
+	return result
+}
+
+// findNodeDuplicateKeys returns the duplicate keys of node and of its children.
+func findNodeDuplicateKeys(node *yamlv3.Node) []duplicateKey {
+	result := []duplicateKey{}
+
+	if node.Kind == yamlv3.MappingNode {
+		seen := map[string]int{}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			// Merge keys can be repeated
+			if key.Kind != yamlv3.ScalarNode || key.Tag == "!!merge" {
+				continue
+			}
+			if firstLine, ok := seen[key.Value]; ok {
+				result = append(result, duplicateKey{key: key.Value, line: key.Line, firstLine: firstLine})
+				continue
+			}
+			seen[key.Value] = key.Line
+		}
+	}
+
+	for _, child := range node.Content {
+		result = append(result, findNodeDuplicateKeys(child)...)
+	}
+
+	return result
+}
+
+// checkDuplicateKeys reports the duplicate keys of the file p.
+// With --strict, they are returned as an error, otherwise a warning is printed
+// once per file.
+func checkDuplicateKeys(p string, documents []yamlDocument) error {
+	duplicates := findDuplicateKeys(documents)
+	if len(duplicates) == 0 {
+		return nil
+	}
+
+	messages := []string{}
+	for _, duplicate := range duplicates {
+		messages = append(messages, fmt.Sprintf("%s:%d: key %q already defined at line %d",
+			displayPath(p), duplicate.line, duplicate.key, duplicate.firstLine))
+	}
+
+	if strictFlag {
+		return fmt.Errorf("%w: %s", ErrorDuplicateKey, strings.Join(messages, ", "))
+	}
+
+	if !warnedDuplicateKeys[p] {
+		warnedDuplicateKeys[p] = true
+		for _, message := range messages {
+			logErr.Println("WARNING: duplicate key:", message)
+		}
+	}
+	return nil
+}
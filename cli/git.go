@@ -2,22 +2,68 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"io"
+	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/go-git/go-billy/v5/osfs"
 	git "github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
 	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/filesystem"
 )
 
+// workTree returns the top-level directory of the git working tree.
+func workTree() string {
+	if workTreeFlag != "" {
+		return workTreeFlag
+	}
+	return rootFlag
+}
+
+// openRepo opens the git repository of path.
+// If --git-dir is set, the repository is opened from that directory instead,
+// which allows the working tree to not contain any .git.
+func openRepo(path string) (*git.Repository, error) {
+	if gitDirFlag == "" {
+		return git.PlainOpenWithOptions(path, &git.PlainOpenOptions{DetectDotGit: true})
+	}
+
+	return git.Open(
+		filesystem.NewStorage(osfs.New(gitDirFlag), cache.NewObjectLRUDefault()),
+		osfs.New(workTree()),
+	)
+}
+
+// gitCommand returns the git command to run from dir.
+// If --git-dir is set, the git directory and the working tree are passed to the command.
+func gitCommand(dir string, args ...string) *exec.Cmd {
+	if gitDirFlag != "" {
+		args = append([]string{"--git-dir=" + gitDirFlag, "--work-tree=" + workTree()}, args...)
+	}
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	logDebug.Println(cmd)
+
+	return cmd
+}
+
 func isRepo(path string) bool {
-	_, err := git.PlainOpenWithOptions(path, &git.PlainOpenOptions{DetectDotGit: true})
+	_, err := openRepo(path)
 	return err == nil
 }
 
 func findMostRecentCommit(p string, related []Include) *object.Commit {
-	repo, err := git.PlainOpenWithOptions(p, &git.PlainOpenOptions{DetectDotGit: true})
+	repo, err := openRepo(p)
 	if err != nil {
 		logErr.Fatal("Can't open repository", p, err)
 	}
@@ -72,11 +118,8 @@ func findMostRecentCommitCmd(p string, related []Include) *object.Commit {
 		args = append(args, r.path)
 	}
 
-	cmd := exec.Command("git", args...)
-	logDebug.Println(cmd)
-
 	// Run git log from the directory of the catalog item
-	cmd.Dir = filepath.Dir(p)
+	cmd := gitCommand(filepath.Dir(p), args...)
 
 	var out bytes.Buffer
 	cmd.Stdout = &out
@@ -86,14 +129,548 @@ func findMostRecentCommitCmd(p string, related []Include) *object.Commit {
 		logErr.Fatal("git log error:", err)
 	}
 
-	repo, err := git.PlainOpenWithOptions(p, &git.PlainOpenOptions{DetectDotGit: true})
+	// No commit touches the files, for example when they are all untracked
+	hash := strings.TrimSpace(out.String())
+	if hash == "" {
+		return nil
+	}
+
+	repo, err := openRepo(p)
 	if err != nil {
 		logErr.Fatal("Can't open repository", p, err)
 	}
 
-	commit, err := repo.CommitObject(plumbing.NewHash(out.String()))
+	commit, err := repo.CommitObject(plumbing.NewHash(hash))
+	if err != nil {
+		logErr.Fatal(err)
+	}
+	return commit
+}
+
+// findDirtyFiles returns the files of the list that have uncommitted changes
+// or are untracked. Paths are relative to the root of the repository.
+func findDirtyFiles(p string, related []Include) []string {
+	repo, err := openRepo(p)
+	if err != nil {
+		logErr.Fatal("Can't open repository", p, err)
+	}
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		logErr.Fatal("Can't open worktree", p, err)
+	}
+
+	status, err := wt.Status()
+	if err != nil {
+		logErr.Fatal("Can't read git status", p, err)
+	}
+
+	return dirtyFiles(wt, status, append([]Include{{path: p}}, related...))
+}
+
+// dirtyFiles returns the files of the list that are modified or untracked in status.
+// Paths are relative to the root of the worktree.
+func dirtyFiles(wt *git.Worktree, status git.Status, files []Include) []string {
+	done := map[string]bool{}
+	result := []string{}
+	for _, f := range files {
+		rel, err := filepath.Rel(wt.Filesystem.Root(), abs(f.path))
+		if err != nil {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+
+		if done[rel] {
+			continue
+		}
+		done[rel] = true
+
+		if s, ok := status[rel]; ok && (s.Worktree != git.Unmodified || s.Staging != git.Unmodified) {
+			result = append(result, rel)
+		}
+	}
+
+	sort.Strings(result)
+	return result
+}
+
+func findDirtyFilesCmd(p string, related []Include) []string {
+	paths := []string{p}
+	for _, r := range related {
+		paths = append(paths, r.path)
+	}
+
+	return gitStatusCmd(filepath.Dir(p), paths)
+}
+
+// gitStatusCmd returns the files matching paths that have uncommitted changes
+// or are untracked. If paths is empty, the whole repository is considered.
+func gitStatusCmd(dir string, paths []string) []string {
+	args := append([]string{
+		"status",
+		"--porcelain",
+		"-z",
+		"--untracked-files=all",
+		"--",
+	}, paths...)
+
+	cmd := gitCommand(dir, args...)
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+
+	if err := cmd.Run(); err != nil {
+		logErr.Fatal("git status error:", err)
+	}
+
+	done := map[string]bool{}
+	result := []string{}
+	entries := strings.Split(out.String(), "\x00")
+	for i := 0; i < len(entries); i++ {
+		// Each entry is 'XY PATH'
+		if len(entries[i]) < 4 {
+			continue
+		}
+		rel := entries[i][3:]
+
+		// Renames and copies are followed by the original path, skip it
+		if entries[i][0] == 'R' || entries[i][0] == 'C' {
+			i++
+		}
+
+		if done[rel] {
+			continue
+		}
+		done[rel] = true
+		result = append(result, rel)
+	}
+
+	sort.Strings(result)
+	return result
+}
+
+// commitIndex knows, for every file of a repository, the most recent commit
+// that changed it, and which files have uncommitted changes.
+// It is built by walking the history once, so it can be used when merging
+// many catalog items instead of running a git log for each of them.
+type commitIndex struct {
+	repo *git.Repository
+	// Root of the worktree
+	root string
+	// Commits, most recent first
+	commits []plumbing.Hash
+	// Relative path => position of the most recent commit in commits
+	files map[string]int
+	// Relative paths of files with uncommitted changes
+	dirty map[string]bool
+}
+
+func newCommitIndex(root string) *commitIndex {
+	repo, err := openRepo(root)
+	if err != nil {
+		logErr.Fatal("Can't open repository", root, err)
+	}
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		logErr.Fatal("Can't open worktree", root, err)
+	}
+
+	return &commitIndex{
+		repo:  repo,
+		root:  wt.Filesystem.Root(),
+		files: map[string]int{},
+		dirty: map[string]bool{},
+	}
+}
+
+// add records that commit changed the files, unless a more recent commit
+// already did.
+func (idx *commitIndex) add(commit plumbing.Hash, files []string) {
+	position := len(idx.commits)
+	idx.commits = append(idx.commits, commit)
+
+	for _, f := range files {
+		if _, ok := idx.files[f]; !ok {
+			idx.files[f] = position
+		}
+	}
+}
+
+// buildCommitIndex walks the history of the repository once using pure-go.
+// Like git log, merge commits are not considered as changing files.
+func buildCommitIndex(root string) *commitIndex {
+	idx := newCommitIndex(root)
+
+	cIter, err := idx.repo.Log(&git.LogOptions{Order: git.LogOrderCommitterTime})
+	if err != nil {
+		logErr.Fatal("Can't read git log", root, err)
+	}
+
+	if err := cIter.ForEach(func(c *object.Commit) error {
+		files := []string{}
+
+		tree, err := c.Tree()
+		if err != nil {
+			return err
+		}
+
+		switch c.NumParents() {
+		case 0:
+			if err := tree.Files().ForEach(func(f *object.File) error {
+				files = append(files, f.Name)
+				return nil
+			}); err != nil {
+				return err
+			}
+		case 1:
+			parent, err := c.Parent(0)
+			if err != nil {
+				return err
+			}
+			parentTree, err := parent.Tree()
+			if err != nil {
+				return err
+			}
+			changes, err := object.DiffTree(parentTree, tree)
+			if err != nil {
+				return err
+			}
+			for _, change := range changes {
+				if change.From.Name != "" {
+					files = append(files, change.From.Name)
+				}
+				if change.To.Name != "" {
+					files = append(files, change.To.Name)
+				}
+			}
+		}
+
+		idx.add(c.Hash, files)
+		return nil
+	}); err != nil {
+		logErr.Fatalf("Error while walking commits: %v", err)
+	}
+
+	wt, _ := idx.repo.Worktree()
+	status, err := wt.Status()
+	if err != nil {
+		logErr.Fatal("Can't read git status", root, err)
+	}
+	for f, s := range status {
+		if s.Worktree != git.Unmodified || s.Staging != git.Unmodified {
+			idx.dirty[f] = true
+		}
+	}
+
+	return idx
+}
+
+// buildCommitIndexCmd walks the history of the repository once using the git command.
+func buildCommitIndexCmd(root string) *commitIndex {
+	idx := newCommitIndex(root)
+
+	// Commits are prefixed with \x01 to tell them apart from file names
+	cmd := gitCommand(idx.root, "log", "-z", "--no-renames", "--name-only", "--format=%x01%H")
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+
+	if err := cmd.Run(); err != nil {
+		logErr.Fatal("git log error:", err)
+	}
+
+	var commit plumbing.Hash
+	files := []string{}
+	for _, token := range strings.Split(out.String(), "\x00") {
+		token = strings.TrimPrefix(token, "\n")
+		if strings.HasPrefix(token, "\x01") {
+			if !commit.IsZero() {
+				idx.add(commit, files)
+			}
+			commit = plumbing.NewHash(token[1:])
+			files = []string{}
+			continue
+		}
+		if token != "" {
+			files = append(files, token)
+		}
+	}
+	if !commit.IsZero() {
+		idx.add(commit, files)
+	}
+
+	for _, f := range gitStatusCmd(idx.root, []string{}) {
+		idx.dirty[f] = true
+	}
+
+	return idx
+}
+
+func (idx *commitIndex) relative(p string) (string, bool) {
+	rel, err := filepath.Rel(idx.root, abs(p))
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// findMostRecentCommit is the indexed equivalent of findMostRecentCommit().
+func (idx *commitIndex) findMostRecentCommit(p string, related []Include) *object.Commit {
+	position := -1
+	for _, f := range append([]Include{{path: p}}, related...) {
+		rel, ok := idx.relative(f.path)
+		if !ok {
+			continue
+		}
+		if pos, ok := idx.files[rel]; ok && (position == -1 || pos < position) {
+			position = pos
+		}
+	}
+
+	if position == -1 {
+		return nil
+	}
+
+	commit, err := idx.repo.CommitObject(idx.commits[position])
 	if err != nil {
 		logErr.Fatal(err)
 	}
 	return commit
 }
+
+// findDirtyFiles is the indexed equivalent of findDirtyFiles().
+func (idx *commitIndex) findDirtyFiles(p string, related []Include) []string {
+	done := map[string]bool{}
+	result := []string{}
+	for _, f := range append([]Include{{path: p}}, related...) {
+		rel, ok := idx.relative(f.path)
+		if !ok || done[rel] {
+			continue
+		}
+		done[rel] = true
+		if idx.dirty[rel] {
+			result = append(result, rel)
+		}
+	}
+
+	sort.Strings(result)
+	return result
+}
+
+// lastCommitIndex is used, when initialized, to find the most recent commits
+// instead of walking the history for every catalog item.
+var lastCommitIndex *commitIndex
+
+// Status of the signature of a commit
+const (
+	// signed by a key of the keyring
+	signatureGood = "good"
+	// signed, but the signature does not match the commit
+	signatureBad = "bad"
+	// signed by a key that is not in the keyring, or that can't be checked
+	signatureUntrusted = "untrusted"
+	// not signed
+	signatureUnsigned = "unsigned"
+)
+
+var regexGoodSSHSignature = regexp.MustCompile(`Good "git" signature (?:for (.+) )?with \S+ key (\S+)`)
+
+// verifyCommitSignature checks the GPG or SSH signature of a commit.
+// keyring is either an armored GPG keyring or an SSH allowed signers file.
+// Returns the signature information: status, type, signer and key.
+func verifyCommitSignature(dir string, commit *object.Commit, keyring string) map[string]any {
+	result := map[string]any{"status": signatureUnsigned}
+
+	if commit.PGPSignature == "" {
+		return result
+	}
+
+	content, err := os.ReadFile(keyring)
+	if err != nil {
+		logErr.Fatalf("Can't read keyring %s: %v", keyring, err)
+	}
+	isGPGKeyring := bytes.Contains(content, []byte("-----BEGIN PGP PUBLIC KEY BLOCK-----"))
+
+	result["status"] = signatureUntrusted
+
+	switch {
+	case strings.HasPrefix(commit.PGPSignature, "-----BEGIN PGP SIGNATURE-----"):
+		result["type"] = "gpg"
+		if !isGPGKeyring {
+			return result
+		}
+
+		entity, err := commit.Verify(string(content))
+		if err != nil {
+			if !errors.Is(err, pgperrors.ErrUnknownIssuer) {
+				logDebug.Println("GPG signature of", commit.Hash, ":", err)
+				result["status"] = signatureBad
+			}
+			return result
+		}
+
+		result["status"] = signatureGood
+		if identity := entity.PrimaryIdentity(); identity != nil {
+			result["signer"] = identity.Name
+		}
+		result["key"] = strings.ToUpper(entity.PrimaryKey.KeyIdString())
+
+	case strings.HasPrefix(commit.PGPSignature, "-----BEGIN SSH SIGNATURE-----"):
+		result["type"] = "ssh"
+		if isGPGKeyring {
+			return result
+		}
+
+		// SSH signatures can only be verified by the git command
+		if _, err := exec.LookPath("git"); err != nil {
+			return result
+		}
+
+		cmd := gitCommand(dir, "-c", "gpg.ssh.allowedSignersFile="+abs(keyring), "verify-commit", commit.Hash.String())
+
+		var out bytes.Buffer
+		cmd.Stderr = &out
+		err := cmd.Run()
+
+		m := regexGoodSSHSignature.FindStringSubmatch(out.String())
+		if m == nil {
+			logDebug.Println("SSH signature of", commit.Hash, ":", out.String())
+			result["status"] = signatureBad
+			return result
+		}
+
+		result["key"] = m[2]
+		if err == nil {
+			result["status"] = signatureGood
+			result["signer"] = m[1]
+		}
+
+	default:
+		result["type"] = "x509"
+	}
+
+	return result
+}
+
+// worktreeRoot returns the top directory of the working tree of the repository of p.
+func worktreeRoot(p string) string {
+	repo, err := openRepo(p)
+	if err != nil {
+		logErr.Fatal("Can't open repository", p, err)
+	}
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		logErr.Fatal("Can't open worktree", p, err)
+	}
+
+	return wt.Filesystem.Root()
+}
+
+// findStagedFiles returns the files with changes staged in the index,
+// relative to the top of the working tree.
+func findStagedFiles(p string) []string {
+	repo, err := openRepo(p)
+	if err != nil {
+		logErr.Fatal("Can't open repository", p, err)
+	}
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		logErr.Fatal("Can't open worktree", p, err)
+	}
+
+	status, err := wt.Status()
+	if err != nil {
+		logErr.Fatal("Can't read git status", p, err)
+	}
+
+	result := []string{}
+	for f, s := range status {
+		if s.Staging != git.Unmodified && s.Staging != git.Untracked {
+			result = append(result, f)
+		}
+	}
+
+	sort.Strings(result)
+	return result
+}
+
+func findStagedFilesCmd(p string) []string {
+	cmd := gitCommand(worktreeRoot(p), "diff", "--cached", "--name-only", "--no-renames", "-z")
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+
+	if err := cmd.Run(); err != nil {
+		logErr.Fatal("git diff error:", err)
+	}
+
+	result := []string{}
+	for _, f := range strings.Split(out.String(), "\x00") {
+		if f != "" {
+			result = append(result, f)
+		}
+	}
+
+	sort.Strings(result)
+	return result
+}
+
+// exportIndex writes the content staged in the index of the repository of p
+// into the directory dest.
+func exportIndex(p string, dest string) {
+	repo, err := openRepo(p)
+	if err != nil {
+		logErr.Fatal("Can't open repository", p, err)
+	}
+
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		logErr.Fatal("Can't read git index", p, err)
+	}
+
+	for _, entry := range idx.Entries {
+		// Ignore conflicts (stages 1 to 3) and submodules
+		if entry.Stage != 0 || entry.Mode == filemode.Submodule {
+			continue
+		}
+
+		blob, err := repo.BlobObject(entry.Hash)
+		if err != nil {
+			logErr.Fatal("Can't read blob of", entry.Name, err)
+		}
+		reader, err := blob.Reader()
+		if err != nil {
+			logErr.Fatal("Can't read blob of", entry.Name, err)
+		}
+		content, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			logErr.Fatal("Can't read blob of", entry.Name, err)
+		}
+
+		target := filepath.Join(dest, filepath.FromSlash(entry.Name))
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			logErr.Fatal(err)
+		}
+
+		if entry.Mode == filemode.Symlink {
+			err = os.Symlink(string(content), target)
+		} else {
+			err = os.WriteFile(target, content, 0o644)
+		}
+		if err != nil {
+			logErr.Fatal(err)
+		}
+	}
+}
+
+func exportIndexCmd(p string, dest string) {
+	cmd := gitCommand(worktreeRoot(p), "checkout-index", "--all", "--prefix="+dest+string(os.PathSeparator))
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		logErr.Fatal("git checkout-index error:", err, string(out))
+	}
+}
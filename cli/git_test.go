@@ -1,7 +1,20 @@
 package main
 
 import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
 )
 
 func TestIsRepo(t *testing.T) {
@@ -25,3 +38,485 @@ func TestFindMostRecentCommit(t *testing.T) {
 	}
 
 }
+
+// initTestRepo creates a git repository in a temporary directory with
+// the files committed, and returns its path.
+func initTestRepo(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFiles(t, dir, files)
+	for name := range files {
+		if _, err := wt.Add(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := wt.Commit("initial commit", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func TestFindDirtyFiles(t *testing.T) {
+	initLoggers()
+	dir := initTestRepo(t, map[string]string{
+		"common.yaml":       "foo: bar\n",
+		"catalog/dev.yaml":  "foo: dev\n",
+		"catalog/prod.yaml": "foo: prod\n",
+	})
+	dev := filepath.Join(dir, "catalog/dev.yaml")
+	related := []Include{
+		{path: filepath.Join(dir, "common.yaml")},
+		{path: dev},
+		{path: filepath.Join(dir, "catalog/description.adoc")},
+	}
+
+	for name, find := range map[string]func(string, []Include) []string{
+		"go-git": findDirtyFiles,
+		"cmd":    findDirtyFilesCmd,
+	} {
+		if dirty := find(dev, related); len(dirty) != 0 {
+			t.Error(name, "clean worktree reported as dirty:", dirty)
+		}
+	}
+
+	// Modify a file of the merge list, a file outside of it, and add an untracked related file
+	if err := os.WriteFile(filepath.Join(dir, "common.yaml"), []byte("foo: changed\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "catalog/prod.yaml"), []byte("foo: changed\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "catalog/description.adoc"), []byte("new\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"catalog/description.adoc", "common.yaml"}
+	for name, find := range map[string]func(string, []Include) []string{
+		"go-git": findDirtyFiles,
+		"cmd":    findDirtyFilesCmd,
+	} {
+		if dirty := find(dev, related); !reflect.DeepEqual(dirty, expected) {
+			t.Error(name, "expected", expected, "got", dirty)
+		}
+	}
+}
+
+func TestCommitIndex(t *testing.T) {
+	initLoggers()
+	dir := initTestRepo(t, map[string]string{
+		"common.yaml":       "foo: bar\n",
+		"catalog/dev.yaml":  "foo: dev\n",
+		"catalog/prod.yaml": "foo: prod\n",
+	})
+
+	// Second commit changes only prod.yaml
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, _ := repo.Worktree()
+	if err := os.WriteFile(filepath.Join(dir, "catalog/prod.yaml"), []byte("foo: changed\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wt.Add("catalog/prod.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	second, err := wt.Commit("second commit", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now().Add(time.Minute)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "common.yaml"), []byte("foo: dirty\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	common := []Include{{path: filepath.Join(dir, "common.yaml")}}
+	dev := filepath.Join(dir, "catalog/dev.yaml")
+	prod := filepath.Join(dir, "catalog/prod.yaml")
+
+	for name, idx := range map[string]*commitIndex{
+		"go-git": buildCommitIndex(dir),
+		"cmd":    buildCommitIndexCmd(dir),
+	} {
+		for _, p := range []string{dev, prod} {
+			expected := findMostRecentCommit(p, common)
+			if commit := idx.findMostRecentCommit(p, common); commit == nil || commit.Hash != expected.Hash {
+				t.Error(name, p, "expected", expected.Hash, "got", commit)
+			}
+		}
+
+		if commit := idx.findMostRecentCommit(prod, common); commit == nil || commit.Hash != second {
+			t.Error(name, "most recent commit of prod.yaml should be the second commit")
+		}
+
+		if dirty := idx.findDirtyFiles(dev, common); !reflect.DeepEqual(dirty, []string{"common.yaml"}) {
+			t.Error(name, "expected common.yaml to be dirty, got", dirty)
+		}
+
+		if commit := idx.findMostRecentCommit(filepath.Join(dir, "unknown.yaml"), []Include{}); commit != nil {
+			t.Error(name, "no commit expected for an unknown file, got", commit.Hash)
+		}
+	}
+}
+
+// writeArmoredKeyring writes the public key of entity into an armored keyring file.
+func writeArmoredKeyring(t *testing.T, entity *openpgp.Entity) string {
+	p := filepath.Join(t.TempDir(), "keyring.asc")
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w, err := armor.Encode(f, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestVerifyCommitSignatureGPG(t *testing.T) {
+	initLoggers()
+	dir := initTestRepo(t, map[string]string{"dev.yaml": "foo: bar\n"})
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := openpgp.NewEntity("Signer", "", "signer@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := openpgp.NewEntity("Other", "", "other@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := writeArmoredKeyring(t, signer)
+	otherKeyring := writeArmoredKeyring(t, other)
+
+	head, _ := repo.Head()
+	unsigned, _ := repo.CommitObject(head.Hash())
+	if s := verifyCommitSignature(dir, unsigned, keyring); s["status"] != signatureUnsigned {
+		t.Error("expected unsigned commit, got", s)
+	}
+
+	wt, _ := repo.Worktree()
+	hash, err := wt.Commit("signed commit", &git.CommitOptions{
+		Author:  &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+		SignKey: signer,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, _ := repo.CommitObject(hash)
+
+	s := verifyCommitSignature(dir, signed, keyring)
+	if s["status"] != signatureGood || s["type"] != "gpg" || s["signer"] != "Signer <signer@example.com>" {
+		t.Error("expected good GPG signature, got", s)
+	}
+
+	if s := verifyCommitSignature(dir, signed, otherKeyring); s["status"] != signatureUntrusted {
+		t.Error("expected untrusted GPG signature, got", s)
+	}
+}
+
+func TestVerifyCommitSignatureSSH(t *testing.T) {
+	initLoggers()
+	for _, command := range []string{"git", "ssh-keygen"} {
+		if _, err := exec.LookPath(command); err != nil {
+			t.Skip(command, "not found")
+		}
+	}
+
+	dir := initTestRepo(t, map[string]string{"dev.yaml": "foo: bar\n"})
+	keys := t.TempDir()
+
+	run := func(dir string, args ...string) {
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatal(args, string(out), err)
+		}
+	}
+
+	run(keys, "ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", "signer")
+	run(keys, "ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", "other")
+	run(dir, "git", "-c", "user.name=test", "-c", "user.email=test@example.com",
+		"-c", "gpg.format=ssh", "-c", "user.signingkey="+filepath.Join(keys, "signer"),
+		"commit", "--allow-empty", "-q", "-S", "-m", "signed commit")
+
+	for name, key := range map[string]string{"allowed": "signer.pub", "other": "other.pub"} {
+		content, err := os.ReadFile(filepath.Join(keys, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(keys, name), append([]byte("signer@example.com "), content...), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	repo, _ := git.PlainOpen(dir)
+	head, _ := repo.Head()
+	signed, _ := repo.CommitObject(head.Hash())
+
+	s := verifyCommitSignature(dir, signed, filepath.Join(keys, "allowed"))
+	if s["status"] != signatureGood || s["type"] != "ssh" || s["signer"] != "signer@example.com" {
+		t.Error("expected good SSH signature, got", s)
+	}
+
+	if s := verifyCommitSignature(dir, signed, filepath.Join(keys, "other")); s["status"] != signatureUntrusted {
+		t.Error("expected untrusted SSH signature, got", s)
+	}
+}
+
+func TestSeparateGitDir(t *testing.T) {
+	initLoggers()
+	dir := initTestRepo(t, map[string]string{
+		"common.yaml":      "foo: bar\n",
+		"catalog/dev.yaml": "foo: dev\n",
+	})
+
+	// Move the .git directory out of the working tree
+	gitDir := filepath.Join(t.TempDir(), "repo.git")
+	if err := os.Rename(filepath.Join(dir, ".git"), gitDir); err != nil {
+		t.Fatal(err)
+	}
+
+	dev := filepath.Join(dir, "catalog/dev.yaml")
+	if isRepo(dev) {
+		t.Error(dev, "should not be in a repo without --git-dir")
+	}
+
+	prevRoot := rootFlag
+	defer func() {
+		gitDirFlag = ""
+		workTreeFlag = ""
+		rootFlag = prevRoot
+	}()
+	gitDirFlag = gitDir
+	workTreeFlag = dir
+	rootFlag = dir
+
+	if !isRepo(dev) {
+		t.Fatal(dev, "should be in a repo with --git-dir")
+	}
+
+	commit := findMostRecentCommit(dev, []Include{})
+	if commit == nil {
+		t.Fatal("no commit found with --git-dir")
+	}
+
+	if commitCmd := findMostRecentCommitCmd(dev, []Include{}); commitCmd.Hash != commit.Hash {
+		t.Error("git command found", commitCmd.Hash, "expected", commit.Hash)
+	}
+
+	if dirty := findDirtyFilesCmd(dev, []Include{}); len(dirty) != 0 {
+		t.Error("clean worktree reported as dirty:", dirty)
+	}
+}
+
+func TestRequireClean(t *testing.T) {
+	initLoggers()
+	logErr = log.New(io.Discard, "!!! ", log.LstdFlags)
+	prevRequireClean, prevGit, prevRoot := requireCleanFlag, gitFlag, rootFlag
+	defer func() {
+		requireCleanFlag = prevRequireClean
+		gitFlag = prevGit
+		rootFlag = prevRoot
+		initConf(rootFlag)
+	}()
+	requireCleanFlag = true
+	gitFlag = true
+
+	dir := initTestRepo(t, map[string]string{
+		"common.yaml":      "foo: bar\n",
+		"catalog/dev.yaml": "foo: dev\n",
+	})
+	rootFlag = dir
+	initConf(rootFlag)
+	dev := filepath.Join(dir, "catalog/dev.yaml")
+
+	if _, _, err := mergeVars(dev, mergeStrategies); err != nil {
+		t.Error("clean merge list should pass, got", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "common.yaml"), []byte("foo: changed\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := mergeVars(dev, mergeStrategies); !errors.Is(err, ErrorDirtyMergeList) {
+		t.Error("ErrorDirtyMergeList expected, got", err)
+	}
+
+	// An untracked item has no commit, and is reported as dirty
+	untracked := initTestRepo(t, map[string]string{"catalog/dev.yaml": "foo: dev\n"})
+	writeTestFiles(t, untracked, map[string]string{"other/new.yaml": "foo: new\n"})
+	rootFlag = untracked
+	initConf(rootFlag)
+	newItem := filepath.Join(untracked, "other/new.yaml")
+
+	if commit := findMostRecentCommitCmd(newItem, []Include{}); commit != nil {
+		t.Error("no commit expected for an untracked item, got", commit.Hash)
+	}
+	if _, _, err := mergeVars(newItem, mergeStrategies); !errors.Is(err, ErrorDirtyMergeList) {
+		t.Error("ErrorDirtyMergeList expected for an untracked item, got", err)
+	}
+
+	requireCleanFlag = false
+	merged, _, err := mergeVars(newItem, mergeStrategies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found, value, _, _ := Get(merged, "/__meta__/last_update/git/dirty"); !found || value != true {
+		t.Error("expected dirty = true for an untracked item, got", value)
+	}
+	if found, value, _, _ := Get(merged, "/__meta__/last_update/git/dirty_files"); !found || !reflect.DeepEqual(value, []any{"other/new.yaml"}) {
+		t.Error("expected the untracked item in dirty_files, got", value)
+	}
+	requireCleanFlag = true
+	rootFlag = dir
+	initConf(rootFlag)
+
+	// Without git information, the merge cannot be guaranteed clean
+	gitFlag = false
+	if _, _, err := mergeVars(dev, mergeStrategies); !errors.Is(err, ErrorNoGitInfo) {
+		t.Error("ErrorNoGitInfo expected with --git=false, got", err)
+	}
+
+	gitFlag = true
+	notRepo := t.TempDir()
+	if err := os.WriteFile(filepath.Join(notRepo, "dev.yaml"), []byte("foo: dev\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rootFlag = notRepo
+	initConf(rootFlag)
+	if _, _, err := mergeVars(filepath.Join(notRepo, "dev.yaml"), mergeStrategies); !errors.Is(err, ErrorNoGitInfo) {
+		t.Error("ErrorNoGitInfo expected out of a repository, got", err)
+	}
+}
+
+func TestRequireCleanOverlay(t *testing.T) {
+	initLoggers()
+	logErr = log.New(io.Discard, "!!! ", log.LstdFlags)
+	prevRequireClean, prevGit, prevOverlayRoot, prevRoot := requireCleanFlag, gitFlag, overlayRootFlag, rootFlag
+	defer func() {
+		requireCleanFlag = prevRequireClean
+		gitFlag = prevGit
+		overlayRootFlag = prevOverlayRoot
+		rootFlag = prevRoot
+		initConf(rootFlag)
+	}()
+	requireCleanFlag = true
+	gitFlag = true
+
+	dir := initTestRepo(t, map[string]string{"catalog/dev.yaml": "foo: dev\n"})
+	overlay := initTestRepo(t, map[string]string{"catalog/dev.yaml": "secret: committed\n"})
+	rootFlag = dir
+	overlayRootFlag = overlay
+	initConf(rootFlag)
+	dev := filepath.Join(dir, "catalog/dev.yaml")
+
+	if _, _, err := mergeVars(dev, mergeStrategies); err != nil {
+		t.Error("clean overlay should pass, got", err)
+	}
+
+	// The overlay is checked in its own repository
+	if err := os.WriteFile(filepath.Join(overlay, "catalog/dev.yaml"), []byte("secret: changed\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := mergeVars(dev, mergeStrategies); !errors.Is(err, ErrorDirtyMergeList) {
+		t.Error("ErrorDirtyMergeList expected for a dirty overlay file, got", err)
+	}
+
+	notRepo := t.TempDir()
+	writeTestFiles(t, notRepo, map[string]string{"catalog/dev.yaml": "secret: untracked\n"})
+	overlayRootFlag = notRepo
+	if _, _, err := mergeVars(dev, mergeStrategies); !errors.Is(err, ErrorNoGitInfo) {
+		t.Error("ErrorNoGitInfo expected for an overlay out of a repository, got", err)
+	}
+}
+
+func TestRequireSigned(t *testing.T) {
+	initLoggers()
+	logErr = log.New(io.Discard, "!!! ", log.LstdFlags)
+	prevRequireSigned, prevKeyring, prevGit, prevRoot := requireSignedFlag, keyringFlag, gitFlag, rootFlag
+	defer func() {
+		requireSignedFlag = prevRequireSigned
+		keyringFlag = prevKeyring
+		gitFlag = prevGit
+		rootFlag = prevRoot
+		initConf(rootFlag)
+	}()
+	requireSignedFlag = true
+	gitFlag = true
+
+	dir := initTestRepo(t, map[string]string{"catalog/dev.yaml": "foo: dev\n"})
+	rootFlag = dir
+	initConf(rootFlag)
+	dev := filepath.Join(dir, "catalog/dev.yaml")
+
+	if _, _, err := mergeVars(dev, mergeStrategies); !errors.Is(err, ErrorNoKeyring) {
+		t.Error("ErrorNoKeyring expected, got", err)
+	}
+
+	signer, err := openpgp.NewEntity("Signer", "", "signer@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyringFlag = writeArmoredKeyring(t, signer)
+
+	// The initial commit is not signed
+	if _, _, err := mergeVars(dev, mergeStrategies); !errors.Is(err, ErrorUnsignedCommit) {
+		t.Error("ErrorUnsignedCommit expected, got", err)
+	}
+
+	if err := os.WriteFile(dev, []byte("foo: signed\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, _ := repo.Worktree()
+	if _, err := wt.Add("catalog/dev.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wt.Commit("signed commit", &git.CommitOptions{
+		Author:  &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+		SignKey: signer,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	merged, _, err := mergeVars(dev, mergeStrategies)
+	if err != nil {
+		t.Fatal("signed commit should pass, got", err)
+	}
+	if _, status, _, _ := Get(merged, "/__meta__/last_update/git/signature/status"); status != signatureGood {
+		t.Error("expected a good signature, got", status)
+	}
+
+	// Without git information, the signature cannot be verified
+	gitFlag = false
+	if _, _, err := mergeVars(dev, mergeStrategies); !errors.Is(err, ErrorNoGitInfo) {
+		t.Error("ErrorNoGitInfo expected with --git=false, got", err)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+)
+
+// ignoreFileName is the file, at the root or in any directory, listing the
+// paths that are never catalog items, using the gitignore syntax.
+const ignoreFileName = ".agnosticvignore"
+
+// ignorePatternsCache caches the patterns of the ignore file of each directory
+var ignorePatternsCache = map[string][]gitignore.Pattern{}
+
+// readIgnorePatterns returns the patterns of the ignore file in dir.
+// domain is the path of dir, from the root, as a list of directory names.
+func readIgnorePatterns(dir string, domain []string) []gitignore.Pattern {
+	if patterns, ok := ignorePatternsCache[dir]; ok {
+		return patterns
+	}
+
+	patterns := []gitignore.Pattern{}
+	file, err := os.Open(filepath.Join(dir, ignoreFileName))
+	if err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimRight(scanner.Text(), " \t\r")
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			patterns = append(patterns, gitignore.ParsePattern(line, domain))
+		}
+	}
+
+	ignorePatternsCache[dir] = patterns
+	return patterns
+}
+
+// isIgnored returns true if p is excluded by the ignore files of root and of
+// the directories between root and p. The patterns of a directory take
+// precedence over the patterns of its parents.
+func isIgnored(root string, p string, isDir bool) bool {
+	rel, err := filepath.Rel(root, p)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return false
+	}
+
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	patterns := []gitignore.Pattern{}
+	for i := 0; i < len(parts); i++ {
+		dir := filepath.Join(append([]string{root}, parts[:i]...)...)
+		domain := append([]string{}, parts[:i]...)
+		patterns = append(patterns, readIgnorePatterns(dir, domain)...)
+	}
+
+	if len(patterns) == 0 {
+		return false
+	}
+
+	return gitignore.NewMatcher(patterns).Match(parts, isDir)
+}
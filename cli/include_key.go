@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// includeKey is the reserved top-level key to define includes in YAML,
+// as an alternative to the #include comment that does not survive tools
+// that round-trip YAML files.
+//
+//	__include__:
+//	  - /includes/a.yaml
+//	  - path: /includes/b.yaml
+//	    recursive: false
+const includeKey = "__include__"
+
+// ErrorIncludeKey happens when the __include__ key is not a list of paths or includes
+var ErrorIncludeKey = errors.New("invalid " + includeKey)
+
+// parseIncludeKey returns the includes defined in the __include__ key of a YAML document,
+// with the line of each include.
+func parseIncludeKey(content []byte) ([]includeDirective, error) {
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal(content, &doc); err != nil {
+		return []includeDirective{}, err
+	}
+
+	if doc.Kind != yamlv3.DocumentNode || len(doc.Content) == 0 || doc.Content[0].Kind != yamlv3.MappingNode {
+		return []includeDirective{}, nil
+	}
+
+	root := doc.Content[0]
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != includeKey {
+			continue
+		}
+
+		value := root.Content[i+1]
+		if value.Kind != yamlv3.SequenceNode {
+			return []includeDirective{}, fmt.Errorf("%w: line %d: expected a list", ErrorIncludeKey, value.Line)
+		}
+
+		result := []includeDirective{}
+		for _, item := range value.Content {
+			include, err := parseIncludeKeyItem(item)
+			if err != nil {
+				return []includeDirective{}, fmt.Errorf("%w: line %d: %v", ErrorIncludeKey, item.Line, err)
+			}
+			result = append(result, includeDirective{line: item.Line, include: include})
+		}
+		return result, nil
+	}
+
+	return []includeDirective{}, nil
+}
+
+// parseIncludeKeyItem parses an item of the __include__ list, either a path
+// or a dictionary with the path and the same parameters as the #include directive.
+func parseIncludeKeyItem(item *yamlv3.Node) (Include, error) {
+	include := Include{recursive: true}
+
+	switch item.Kind {
+	case yamlv3.ScalarNode:
+		include.path = item.Value
+
+	case yamlv3.MappingNode:
+		for i := 0; i+1 < len(item.Content); i += 2 {
+			key, value := item.Content[i].Value, item.Content[i+1]
+
+			switch key {
+			case "path":
+				include.path = value.Value
+			case "params":
+				if err := value.Decode(&include.params); err != nil {
+					return Include{}, err
+				}
+			case "recursive", "optional", "position", "into":
+				if value.Kind != yamlv3.ScalarNode {
+					return Include{}, fmt.Errorf("%s must be a scalar", key)
+				}
+				v := value.Value
+				if key == "recursive" || key == "optional" {
+					// Accept any YAML boolean
+					var b bool
+					if err := value.Decode(&b); err != nil {
+						return Include{}, fmt.Errorf("%s must be true or false, got %q", key, v)
+					}
+					v = strconv.FormatBool(b)
+				}
+				if err := include.setParam(key, v); err != nil {
+					return Include{}, err
+				}
+			default:
+				return Include{}, fmt.Errorf("unknown include parameter %q", key)
+			}
+		}
+
+	default:
+		return Include{}, errors.New("expected a path or a dictionary")
+	}
+
+	if include.path == "" {
+		return Include{}, ErrorEmptyPath
+	}
+
+	if err := include.setFragment(); err != nil {
+		return Include{}, err
+	}
+
+	return include, nil
+}
@@ -2,19 +2,130 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
-	"os"
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+
+	"github.com/go-openapi/jsonpointer"
 )
 
 // Include represent the include file
 type Include struct {
 	path      string
-	recursive bool // true = process #include in included file (default), false = don't process includes in included file
+	recursive bool              // true = process #include in included file (default), false = don't process includes in included file
+	optional  bool              // true = skip the include if the file does not exist, false = fail (default)
+	fragment  string            // JSON pointer of the subtree to include, ex: /ocp4/large, empty = whole file
+	into      string            // JSON pointer where the content is nested before merging, empty = top level
+	after     bool              // true = merge after the including file (position=after), false = before (default)
+	params    map[string]string // template parameters, substituted for ${name} in the included file only
+	repo      string            // other repository and ref to include the file from, ex: shared@v1.2
+	document  int               // 1-based index of the document in a file with several YAML documents, 0 = whole file
+}
+
+// key identifies an include in the merge list. The same file can be included
+// several times with different fragments or mount points.
+func (include Include) key() string {
+	key := include.path
+	if include.document > 0 {
+		key = fmt.Sprintf("%s[%d]", key, include.document)
+	}
+	if include.fragment != "" {
+		key = key + "#" + include.fragment
+	}
+	if include.into != "" {
+		key = key + " into=" + include.into
+	}
+	names := make([]string, 0, len(include.params))
+	for name := range include.params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		key = key + " " + name + "=" + include.params[name]
+	}
+	return key
+}
+
+// substituteParams replaces the ${name} placeholders of content with the
+// template parameters of the include. Undefined placeholders are errors.
+// Comments and #include directives are kept as is.
+func (include Include) substituteParams(content []byte) ([]byte, error) {
+	var err error
+	result := []byte{}
+	for _, line := range bytes.SplitAfter(content, []byte("\n")) {
+		if bytes.HasPrefix(bytes.TrimLeft(line, " \t"), []byte("#")) {
+			result = append(result, line...)
+			continue
+		}
+
+		line = regexPlaceholder.ReplaceAllFunc(line, func(match []byte) []byte {
+			submatch := regexPlaceholder.FindSubmatch(match)
+			if len(submatch[1]) > 0 {
+				// Escaped placeholder
+				return match[1:]
+			}
+			value, ok := include.params[string(submatch[2])]
+			if !ok {
+				if err == nil {
+					err = fmt.Errorf("%w: %s in %s", ErrorIncludeUndefinedParam, match, include.path)
+				}
+				return match
+			}
+			return []byte(value)
+		})
+		result = append(result, line...)
+	}
+
+	return result, err
+}
+
+// missing returns true if the include is optional and its file does not exist.
+// Missing includes are kept in the merge list, to be considered as related files,
+// but they are not merged.
+func (include Include) missing() bool {
+	return include.optional && !fileExists(include.path)
+}
+
+// setParam sets a parameter of the #include directive, ex: recursive=false
+func (include *Include) setParam(key string, value string) error {
+	switch key {
+	case "recursive", "optional":
+		if value != "true" && value != "false" {
+			return fmt.Errorf("%s must be true or false, got %q", key, value)
+		}
+		if key == "recursive" {
+			include.recursive = value == "true"
+		} else {
+			include.optional = value == "true"
+		}
+	case "position":
+		if value != "before" && value != "after" {
+			return fmt.Errorf("position must be before or after, got %q", value)
+		}
+		include.after = value == "after"
+	case "repo":
+		name, ref, found := strings.Cut(value, "@")
+		if !found || name == "" || ref == "" {
+			return fmt.Errorf("repo must be NAME@REF, got %q", value)
+		}
+		include.repo = value
+	case "into":
+		if !strings.HasPrefix(value, "/") {
+			return fmt.Errorf("into must be a JSON pointer, got %q", value)
+		}
+		if _, err := jsonpointer.New(value); err != nil {
+			return err
+		}
+		include.into = value
+	default:
+		return fmt.Errorf("unknown include parameter %q", key)
+	}
+	return nil
 }
 
 // ErrorIncludeLoop happens in case of an infinite loop between included files
@@ -26,11 +137,83 @@ var ErrorEmptyPath = errors.New("empty path")
 // ErrorIncludeOutOfChroot happens when an include is not in the inside the agnosticV repo.
 var ErrorIncludeOutOfChroot = errors.New("include path is out of chroot")
 
+// ErrorIncludeNotFound happens when an included file does not exist
+var ErrorIncludeNotFound = errors.New("path include does not exist")
+
+// ErrorIncludeUndefinedParam happens when a parameterized include uses
+// a placeholder that is not defined in the #include directive
+var ErrorIncludeUndefinedParam = errors.New("undefined include parameter")
+
+// ErrorIncludeFragment happens when the fragment of an include does not
+// point to a dictionary in the included file
+var ErrorIncludeFragment = errors.New("include fragment must point to a dictionary")
+
+// ErrorIncludeMergeList happens when a catalog item included with
+// recursive=true is not found in its own merge list
+var ErrorIncludeMergeList = errors.New("included catalog item is not in its merge list")
+
+// IncludeFrame is a file of an include chain.
+// Line is the line of the #include directive that includes the next file of
+// the chain, or 0 if the next file is a common file or a meta file.
+type IncludeFrame struct {
+	Path string
+	Line int
+}
+
+// IncludeError is returned when processing includes fails. It carries the
+// whole include chain, from the leaf to the file that caused the error.
+type IncludeError struct {
+	Err   error
+	Chain []IncludeFrame
+}
+
+func (e *IncludeError) Error() string {
+	chain := []string{}
+	for _, frame := range e.Chain {
+		p := displayPath(frame.Path)
+		if rel, err := filepath.Rel(rootFlag, p); err == nil && !strings.HasPrefix(rel, "..") {
+			p = "/" + rel
+		}
+		if frame.Line > 0 {
+			p = fmt.Sprintf("%s:%d", p, frame.Line)
+		}
+		chain = append(chain, p)
+	}
+	return fmt.Sprintf("%v: %s", e.Err, strings.Join(chain, " -> "))
+}
+
+func (e *IncludeError) Unwrap() error {
+	return e.Err
+}
+
+// newIncludeError returns an IncludeError with the chain of the stack followed by path.
+// If err is already an IncludeError, it is returned as is.
+func newIncludeError(err error, stack []IncludeFrame, path string) error {
+	var includeErr *IncludeError
+	if errors.As(err, &includeErr) {
+		return err
+	}
+
+	chain := append([]IncludeFrame{}, stack...)
+	if path != "" {
+		chain = append(chain, IncludeFrame{Path: path})
+	}
+
+	return &IncludeError{Err: err, Chain: chain}
+}
+
 func containsPath(l []Include, p string) bool {
 	for _, a := range l {
 		if a.path == p {
 			return true
 		}
+
+		// Missing optional includes are related to the files they would include
+		if a.missing() {
+			if matched, _ := filepath.Match(a.path, p); matched || filepath.Dir(p) == a.path {
+				return true
+			}
+		}
 	}
 	return false
 }
@@ -40,6 +223,7 @@ func containsPath(l []Include, p string) bool {
 //
 // dev.yaml => dev.meta.yaml
 // dev.yml => dev.meta.yml
+// dev.json => dev.meta.json
 func getMetaPath(path string) (string, error) {
 	if path == "" {
 		return "", ErrorEmptyPath
@@ -49,12 +233,10 @@ func getMetaPath(path string) (string, error) {
 	meta := strings.TrimSuffix(path, extension) + ".meta"
 
 	// Detect which extension to use based on file existence
-	if fileExists(meta + ".yml") {
-		return meta + ".yml", nil
-	}
-
-	if fileExists(meta + ".yaml") {
-		return meta + ".yaml", nil
+	for _, metaExtension := range varsExtensions {
+		if fileExists(meta + metaExtension) {
+			return meta + metaExtension, nil
+		}
 	}
 
 	// Return same extension as file
@@ -62,9 +244,8 @@ func getMetaPath(path string) (string, error) {
 }
 
 func isMetaPath(path string) bool {
-	ext := filepath.Ext(path)
-	if ext == ".yml" || ext == ".yaml" {
-		if filepath.Ext(strings.TrimSuffix(path, ext)) == ".meta" {
+	if hasVarsExtension(path) {
+		if filepath.Ext(strings.TrimSuffix(path, filepath.Ext(path))) == ".meta" {
 			return true
 		}
 	}
@@ -75,26 +256,67 @@ func isMetaPath(path string) bool {
 // function getMergeList return the merge list for a catalog items
 // merge list contains: common files and includes.
 // Note: This function is called either:
-//   1. From main code when user explicitly merges a file (should walk up parent common files)
-//   2. From parseAllIncludes when including a catalog item with recursive=true
+//  1. From main code when user explicitly merges a file (should walk up parent common files)
+//  2. From parseAllIncludes when including a catalog item with recursive=true
+//
 // The caller in parseAllIncludes already checks isCatalogItem before calling this.
+//
+// A file can be reached several times, for example when two included files
+// both include the same file (diamond). It is merged only once, at its first
+// position in the merge list, so the files merged after it can override it,
+// or at its last position=after position, see uniqueIncludes.
 func getMergeList(path string) ([]Include, error) {
+	return getMergeListWithStack(path, []IncludeFrame{})
+}
+
+// getMergeListWithStack is getMergeList with the stack of files being included,
+// used to detect include loops.
+func getMergeListWithStack(path string, stack []IncludeFrame) ([]Include, error) {
 	result := []Include{}
-	done := map[string]bool{}
 
 	for previous, next := "", path; next != "" && next != previous; next = nextCommonFile(next) {
-		allIncludes, innerDone, err := parseAllIncludes(next, done, true)
-		done = innerDone
+		// Keep the leaf in the stack when processing its common files
+		nextStack := stack
+		if next != path {
+			nextStack = append(stack[:len(stack):len(stack)], IncludeFrame{Path: path})
+		}
+
+		before, after, err := parseAllIncludes(next, nextStack, true)
 		if err != nil {
 			logErr.Println("Error loading includes for", next)
 			return result, err
 		}
-		result = append([]Include{{path: next, recursive: true}}, result...)
-		result = append(allIncludes, result...)
+		current := append(before, Include{path: next, recursive: true})
+		current = append(current, after...)
+		result = append(current, result...)
 		previous = next
 	}
 
-	return result, nil
+	return uniqueIncludes(result), nil
+}
+
+// uniqueIncludes removes the files that are present more than once in the
+// merge list, keeping the first position. A file included with position=after
+// is kept at its last position=after occurrence instead, so it still overrides
+// the including file.
+func uniqueIncludes(l []Include) []Include {
+	keep := map[string]int{}
+	for i, include := range l {
+		if _, ok := keep[include.key()]; !ok || include.after {
+			keep[include.key()] = i
+		}
+	}
+
+	result := []Include{}
+	for i, include := range l {
+		if keep[include.key()] != i {
+			logDebug.Println(include.key(), "is included more than once, keep position", keep[include.key()])
+			continue
+		}
+		result = append(result, include)
+	}
+
+	return result
 }
 
 func printPaths(mergeList []Include, workdir string) {
@@ -102,66 +324,173 @@ func printPaths(mergeList []Include, workdir string) {
 		fmt.Println("# MERGED:")
 	}
 	for i := 0; i < len(mergeList); i = i + 1 {
-		if relativePath, err := filepath.Rel(workdir, mergeList[i].path); err == nil && len(relativePath) < len(mergeList[i].path) {
-			fmt.Printf("#   %s\n", relativePath)
+		if mergeList[i].missing() {
+			continue
+		}
+		annotations := strings.TrimPrefix(mergeList[i].key(), mergeList[i].path)
+		if mergeList[i].after {
+			annotations = annotations + " position=after"
+		}
+		if _, _, ok := externalRepository(mergeList[i].path); ok {
+			fmt.Printf("#   %s%s\n", displayPath(mergeList[i].path), annotations)
+		} else if relativePath, err := filepath.Rel(workdir, mergeList[i].path); err == nil && len(relativePath) < len(mergeList[i].path) {
+			fmt.Printf("#   %s%s\n", relativePath, annotations)
 		} else {
-			fmt.Printf("#   %s\n", mergeList[i].path)
+			fmt.Printf("#   %s%s\n", mergeList[i].path, annotations)
 		}
 	}
 }
 
 // Regex to match #include directive
-// Supports: #include /path, #include recursive=false /path, #include recursive=true /path
-var regexInclude = regexp.MustCompile(`^[ \t]*#include(?:[ \t]+recursive=(true|false))?[ \t]+("(.*?[^\\])"|([^ \t]+))[ \t]*$`)
+// Supports: #include /path, #include PARAM=VALUE [PARAM=VALUE ...] /path [NAME=VALUE ...]
+// ex: #include recursive=false optional=true /path
+// ex: #include into=/__meta__/catalog/parameters /path
+// ex: #include position=after /path
+// ex: #include repo=shared@v1.2 /path
+// The path can end with a JSON pointer fragment, ex: /path#/key/subkey
+var regexInclude = regexp.MustCompile(`^[ \t]*#include((?:[ \t]+[a-z_]+=[^ \t"]+)*)[ \t]+("(.*?[^\\])"|([^ \t]+))((?:[ \t]+[A-Za-z_][A-Za-z0-9_]*=(?:"[^"]*"|[^ \t"]+))*)[ \t]*$`)
+
+// Regex to match the template parameters after the path of an #include directive
+// ex: version=4.14 name="with space"
+var regexIncludeParam = regexp.MustCompile(`([A-Za-z_][A-Za-z0-9_]*)=(?:"([^"]*)"|([^ \t"]+))`)
+
+// Regex to match the placeholders in a parameterized include, ex: ${version}
+// $${version} is an escaped placeholder, replaced by ${version}
+var regexPlaceholder = regexp.MustCompile(`\$(\$?)\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Regex to match a line that is meant to be an #include directive
+var regexIncludeLine = regexp.MustCompile(`^[ \t]*#include([ \t]|$)`)
+
+// ErrorIncludeSyntax happens when an #include directive cannot be parsed
+var ErrorIncludeSyntax = errors.New("invalid #include directive")
 
 // parseInclude function parses the includes in a line
-// Returns: (found, Include)
-func parseInclude(line string) (bool, Include) {
+// Returns: (found, Include, error)
+// A line starting with #include that cannot be parsed is an error, so the
+// include is never silently dropped.
+func parseInclude(line string) (bool, Include, error) {
 	result := regexInclude.FindAllStringSubmatch(line, -1)
 
-	if len(result) == 0 {
-		return false, Include{}
-	}
-
-	if len(result) > 1 {
-		logErr.Println("Could not parse include line:", line)
-		return false, Include{}
+	if len(result) != 1 || len(result[0]) < 6 {
+		if regexIncludeLine.MatchString(line) {
+			return false, Include{}, fmt.Errorf("%w: %s", ErrorIncludeSyntax, line)
+		}
+		return false, Include{}, nil
 	}
 
-	if len(result[0]) < 5 {
-		logErr.Println("Could not parse include line:", line)
-		return false, Include{}
-	}
+	// Default parameters
+	include := Include{recursive: true}
 
-	// Extract recursive parameter if present (default is true)
-	recursive := true
-	recursiveParam := result[0][1]
-	if recursiveParam != "" {
-		recursive = (recursiveParam == "true")
+	for _, param := range strings.Fields(result[0][1]) {
+		key, value, _ := strings.Cut(param, "=")
+		if err := include.setParam(key, value); err != nil {
+			return false, Include{}, fmt.Errorf("%w: %s: %v", ErrorIncludeSyntax, line, err)
+		}
 	}
 
 	// Extract file path (either quoted or unquoted)
-	var path string
 	if result[0][3] != "" {
 		// Quoted path
-		path = result[0][3]
+		include.path = result[0][3]
 	} else if result[0][4] != "" {
 		// Unquoted path
-		path = result[0][4]
+		include.path = result[0][4]
 	} else {
-		return false, Include{}
+		return false, Include{}, fmt.Errorf("%w: %s", ErrorIncludeSyntax, line)
+	}
+
+	// Template parameters, substituted in the included file
+	for _, param := range regexIncludeParam.FindAllStringSubmatch(result[0][5], -1) {
+		// Directive parameters go before the path, they are not template parameters
+		switch param[1] {
+		case "recursive", "optional", "position", "into", "repo":
+			return false, Include{}, fmt.Errorf("%w: %s: %s must be set before the path", ErrorIncludeSyntax, line, param[1])
+		}
+		if include.params == nil {
+			include.params = map[string]string{}
+		}
+		if param[2] != "" {
+			include.params[param[1]] = param[2]
+		} else {
+			include.params[param[1]] = param[3]
+		}
+	}
+
+	if err := include.setFragment(); err != nil {
+		return false, Include{}, fmt.Errorf("%w: %s: %v", ErrorIncludeSyntax, line, err)
+	}
+
+	return true, include, nil
+}
+
+// setFragment extracts the JSON pointer fragment from the path of the include,
+// ex: /includes/clusters.yaml#/ocp4/large
+func (include *Include) setFragment() error {
+	if p, fragment, found := strings.Cut(include.path, "#/"); found {
+		include.path = p
+		include.fragment = "/" + fragment
+		if _, err := jsonpointer.New(include.fragment); err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+// includeDirective is an include found in a file, with the line where it is defined
+type includeDirective struct {
+	line    int
+	include Include
+}
+
+// readIncludeDirectives returns the includes defined in a file, in the order of
+// their lines, either as #include comments or in the __include__ key.
+func readIncludeDirectives(path string) ([]includeDirective, error) {
+	content, err := readFile(path)
+	if err != nil {
+		return []includeDirective{}, err
+	}
+
+	result := []includeDirective{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
 
-	return true, Include{
-		path:      path,
-		recursive: recursive,
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Text()
+
+		ok, include, err := parseInclude(line)
+		if err != nil {
+			return []includeDirective{}, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		if ok {
+			logDebug.Println("parseInclude(", line, ") recursive=", include.recursive)
+			result = append(result, includeDirective{line: lineNumber, include: include})
+		}
 	}
+
+	// Only parse the YAML when the key may be present
+	if bytes.Contains(content, []byte(includeKey)) {
+		fromKey, err := parseIncludeKey(content)
+		if err != nil {
+			return []includeDirective{}, err
+		}
+		result = append(result, fromKey...)
+		sort.SliceStable(result, func(i, j int) bool {
+			return result[i].line < result[j].line
+		})
+	}
+
+	return result, nil
 }
 
 // parseAllIncludes parses all includes in a file
-// Returns: (includes, done, error)
+// Returns: (before, after, error)
+// before: the includes to merge before the file (default)
+// after: the includes to merge after the file (position=after)
+// stack: the chain of files being included, from the leaf to the file including path.
+// If path is in the stack, it's an include loop.
 // processIncludes: if true, process #include directives within this file
 //
+// Errors are returned as *IncludeError, with the include chain.
+//
 // Meta file behavior:
 //   - Always includes the direct .meta file if it exists (e.g., file.yaml → file.meta.yaml)
 //   - Meta files themselves don't get meta files (no meta.meta.yaml)
@@ -169,99 +498,285 @@ func parseInclude(line string) (bool, Include) {
 //
 // For catalog items/common files: processIncludes is always true
 // For #include files: processIncludes matches the recursive parameter (true by default)
-func parseAllIncludes(path string, done map[string]bool, processIncludes bool) ([]Include, map[string]bool, error) {
-	logDebug.Println("parseAllIncludes(", path, done, "processIncludes=", processIncludes, ")")
+func parseAllIncludes(path string, stack []IncludeFrame, processIncludes bool) ([]Include, []Include, error) {
+	logDebug.Println("parseAllIncludes(", path, stack, "processIncludes=", processIncludes, ")")
 	if !fileExists(path) {
-		logErr.Println(path, "path does not exist")
-		return []Include{}, done, errors.New("path include does not exist")
+		return []Include{}, []Include{}, newIncludeError(ErrorIncludeNotFound, stack, path)
 	}
 
-	if val, ok := done[path]; ok && val {
-		logErr.Println(path, "is included more than once")
-		return []Include{}, done, ErrorIncludeLoop
+	for _, frame := range stack {
+		if frame.Path == path {
+			return []Include{}, []Include{}, newIncludeError(ErrorIncludeLoop, stack, path)
+		}
 	}
 
-	done[path] = true
+	// Full slice expression so the caller's stack is never modified
+	stack = append(stack[:len(stack):len(stack)], IncludeFrame{Path: path})
+	current := &stack[len(stack)-1]
 
 	result := []Include{}
 
+	// The matching file of the overlay is merged after the file and its includes
+	overlayIncludes, err := parseOverlayIncludes(path, stack, processIncludes)
+	if err != nil {
+		return []Include{}, []Include{}, err
+	}
+
+	after := []Include{}
+
 	// Always check if path has a meta file (unless current file is already a meta file)
 	// The meta file itself is always included, but processIncludes controls whether
 	// we process #include directives within the meta file
 	if !isMetaPath(path) {
 		if meta, err := getMetaPath(path); err == nil && fileExists(meta) {
-			innerIncludes, innerDone, err := parseAllIncludes(meta, done, processIncludes)
-			done = innerDone
+			innerIncludes, innerAfter, err := parseAllIncludes(meta, stack, processIncludes)
 			if err != nil {
-				return []Include{}, done, err
+				return []Include{}, []Include{}, err
 			}
 			innerIncludes = append(innerIncludes, Include{path: meta, recursive: true})
+			innerIncludes = append(innerIncludes, innerAfter...)
 			result = append(innerIncludes, result...)
 		}
 	}
 
 	// If processIncludes is false, don't scan for #include directives
 	if !processIncludes {
-		return result, done, nil
+		return result, overlayIncludes, nil
 	}
 
-	file, err := os.Open(path)
+	directives, err := readIncludeDirectives(path)
 	if err != nil {
-		return []Include{}, done, err
+		return []Include{}, []Include{}, newIncludeError(err, stack, "")
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
+	for _, directive := range directives {
+		include := directive.include
+		current.Line = directive.line
 
-	for scanner.Scan() {
-		line := scanner.Text()
+		if include.repo != "" {
+			// Paths are from the top of the other repository
+			name, ref, _ := strings.Cut(include.repo, "@")
+			root, err := repositoryRoot(name, ref)
+			if err != nil {
+				return []Include{}, []Include{}, newIncludeError(err, stack, "")
+			}
+			include.path, err = resolvePath(root, "/"+strings.TrimPrefix(include.path, "/"), root)
+			if err != nil {
+				return []Include{}, []Include{}, newIncludeError(err, stack, "")
+			}
+		} else {
+			include.path, err = resolvePath(rootFor(path), include.path, path)
+			if err != nil {
+				return []Include{}, []Include{}, newIncludeError(err, stack, "")
+			}
+		}
 
-		if ok, include := parseInclude(line); ok {
-			logDebug.Println("parseInclude(", line, ") recursive=", include.recursive)
+		// Includes with position=after are merged after the current file
+		target := &result
+		if include.after {
+			target = &after
+		}
 
-			include.path, err = resolvePath(rootFlag, include.path, path)
-			if err != nil {
-				return []Include{}, done, err
+		// Globs and directories can match several files
+		matches, err := expandIncludePath(include.path)
+		if err != nil {
+			if include.optional && errors.Is(err, ErrorIncludeNotFound) {
+				logDebug.Println("optional include", include.path, "not found")
+				*target = append(*target, include)
+				continue
 			}
+			return []Include{}, []Include{}, newIncludeError(err, stack, include.path)
+		}
+
+		for _, match := range matches {
+			include.path = match
+			var innerIncludes, innerAfter []Include
 
-			var innerIncludes []Include
-			var innerDone map[string]bool
+			if include.missing() {
+				logDebug.Println("optional include", include.path, "not found")
+				*target = append(*target, include)
+				continue
+			}
 
 			// With recursive=false: treat the file as a simple include (no parent common files)
 			// With recursive=true: if it's a catalog item, include its full merge list (with common files)
-			if !include.recursive || !isCatalogItem(rootFlag, include.path) {
+			if !include.recursive || !isCatalogItem(rootFor(include.path), include.path) {
 				// recursive=false OR not a catalog item: just parse the file itself
-				innerIncludes, innerDone, err = parseAllIncludes(include.path, done, include.recursive)
-				done = innerDone
+				innerIncludes, innerAfter, err = parseAllIncludes(include.path, stack, include.recursive)
 				if err != nil {
-					return []Include{}, done, err
+					return []Include{}, []Include{}, err
 				}
 			} else {
 				// recursive=true AND catalog item: get full merge list including common files
-				innerIncludes, err = getMergeList(include.path)
-				// Remove last element, which is the current file
-				innerIncludes = innerIncludes[:len(innerIncludes)-1]
+				mergeList, err := getMergeListWithStack(include.path, stack)
+				if err != nil {
+					return []Include{}, []Include{}, err
+				}
+				// Split around the current file
+				innerIncludes, innerAfter, err = splitMergeList(mergeList, include.path)
 				if err != nil {
-					return []Include{}, done, err
+					return []Include{}, []Include{}, newIncludeError(err, stack, include.path)
 				}
 			}
 
-			innerIncludes = append(innerIncludes, include)
-			result = append(result, innerIncludes...)
+			// The files included by a mounted file are mounted with it
+			if include.into != "" {
+				innerIncludes = mountIncludes(innerIncludes, include.into)
+				innerAfter = mountIncludes(innerAfter, include.into)
+			}
+
+			*target = append(*target, innerIncludes...)
+			*target = append(*target, include)
+			*target = append(*target, innerAfter...)
+		}
+	}
+	return result, append(after, overlayIncludes...), nil
+}
+
+// splitMergeList returns the files merged before and after the catalog item p in its merge list.
+func splitMergeList(mergeList []Include, p string) ([]Include, []Include, error) {
+	for i := len(mergeList) - 1; i >= 0; i-- {
+		if mergeList[i].key() == p {
+			return mergeList[:i], mergeList[i+1:], nil
 		}
 	}
-	return result, done, nil
+	return []Include{}, []Include{}, ErrorIncludeMergeList
+}
+
+// mountIncludes returns a copy of includes with their content nested under the JSON pointer into.
+// Meta files are not nested.
+func mountIncludes(includes []Include, into string) []Include {
+	result := make([]Include, 0, len(includes))
+	for _, include := range includes {
+		if !isMetaPath(include.path) {
+			include.into = into + include.into
+		}
+		result = append(result, include)
+	}
+	return result
+}
+
+// expandIncludePath returns the files an include path refers to:
+//   - a glob pattern, ex: /includes/secrets/*.yaml, refers to the matching files
+//   - a directory, ex: /includes/aws/, refers to the YAML files it contains
+//   - any other path refers to itself
+//
+// Files are returned in sorted order. Meta files are never returned,
+// as they are included along with their file.
+func expandIncludePath(p string) ([]string, error) {
+	if fileExists(p) {
+		fileinfo, err := statFile(p)
+		if err != nil {
+			return []string{}, err
+		}
+		if !fileinfo.IsDir() {
+			return []string{p}, nil
+		}
+	} else if !strings.ContainsAny(p, "*?[") {
+		return []string{p}, nil
+	}
+
+	var candidates []string
+	if fileExists(p) {
+		// Directory
+		entries, err := readDir(p)
+		if err != nil {
+			return []string{}, err
+		}
+		for _, entry := range entries {
+			if hasVarsExtension(entry.Name()) {
+				candidates = append(candidates, filepath.Join(p, entry.Name()))
+			}
+		}
+	} else {
+		// Glob
+		var err error
+		if candidates, err = globFiles(p); err != nil {
+			return []string{}, err
+		}
+	}
+
+	result := []string{}
+	for _, candidate := range candidates {
+		if isMetaPath(candidate) || strings.HasPrefix(filepath.Base(candidate), ".") {
+			continue
+		}
+		if fileinfo, err := statFile(candidate); err != nil || fileinfo.IsDir() {
+			continue
+		}
+		result = append(result, candidate)
+	}
+
+	if len(result) == 0 {
+		return []string{}, ErrorIncludeNotFound
+	}
+
+	sort.Strings(result)
+	return result, nil
 }
 
 // resolvePath return the absolute path, with context
+//
+// Bare names, ex: base.yaml or aws/base.yaml, are searched first in the
+// directory of contextFile, then in the include_paths of the configuration,
+// in order. If the file is found nowhere, the path relative to contextFile
+// is returned.
 func resolvePath(root string, includePath string, contextFile string) (string, error) {
+	if includePath == "" {
+		return "", ErrorEmptyPath
+	}
+
+	var result string
 	if includePath[0] == '/' {
-		return filepath.Join(root, filepath.Clean(includePath)), nil
+		result = filepath.Join(root, filepath.Clean(includePath))
+	} else {
+		result = filepath.Join(path.Dir(contextFile), filepath.Clean(includePath))
+
+		if !isRoot(root, result) {
+			return "", ErrorIncludeOutOfChroot
+		}
+	}
+
+	if overlayRootFlag != "" && !includePathExists(result) {
+		// Look up the file in both the base and the overlay trees
+		if base, ok := basePath(result); ok && includePathExists(base) {
+			return base, nil
+		}
+		if overlay, ok := overlayPath(result); ok && includePathExists(overlay) {
+			return overlay, nil
+		}
 	}
-	result := filepath.Join(path.Dir(contextFile), filepath.Clean(includePath))
 
-	if !isRoot(root, result) {
-		return "", ErrorIncludeOutOfChroot
+	if isBareIncludePath(includePath) && !includePathExists(result) {
+		for _, includeDir := range configFor(filepath.Dir(contextFile)).IncludePaths {
+			candidate := filepath.Join(root, filepath.Clean("/"+includeDir), filepath.Clean(includePath))
+			if includePathExists(candidate) {
+				logDebug.Println("include", includePath, "found in include path", includeDir)
+				return candidate, nil
+			}
+		}
 	}
+
 	return result, nil
 }
+
+// isBareIncludePath returns true if the include path is neither absolute
+// nor explicitly relative to the current file with ./ or ../
+func isBareIncludePath(includePath string) bool {
+	return !strings.HasPrefix(includePath, "/") &&
+		!strings.HasPrefix(includePath, "./") &&
+		!strings.HasPrefix(includePath, "../") &&
+		includePath != "." && includePath != ".."
+}
+
+// includePathExists returns true if the include path refers to at least one file
+func includePathExists(p string) bool {
+	if fileExists(p) {
+		return true
+	}
+	if !strings.ContainsAny(p, "*?[") {
+		return false
+	}
+	_, err := expandIncludePath(p)
+	return err == nil
+}
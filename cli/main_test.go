@@ -26,6 +26,11 @@ func TestFlag(t *testing.T) {
 			description: "List with 'has' flag",
 			result:      controlFlow{false, 0},
 		},
+		{
+			args:        []string{"agnosticv", "--list", "--git", "--has", "__meta__.last_update"},
+			description: "List with git operations explicitly enabled",
+			result:      controlFlow{false, 0},
+		},
 		{
 			args:        []string{"agnosticv", "--merge", "fixtures/test/BABYLON_EMPTY_CONFIG/dev.yaml"},
 			description: "Simple merge",
@@ -125,6 +130,28 @@ func TestFlag(t *testing.T) {
 			description: "-dir is outside -root",
 			result:      controlFlow{true, 2},
 		},
+		{
+			args: []string{"agnosticv",
+				"--merge", "fixtures/test/BABYLON_EMPTY_CONFIG/dev.yaml",
+				"--git=false",
+				"--require-clean"},
+			description: "-require-clean without git",
+			result:      controlFlow{true, 2},
+		},
+		{
+			args: []string{"agnosticv",
+				"--merge", "fixtures/test/BABYLON_EMPTY_CONFIG/dev.yaml",
+				"--keyring", "/tmp/doesntexist"},
+			description: "-keyring that doesn't exist",
+			result:      controlFlow{true, 1},
+		},
+		{
+			args: []string{"agnosticv",
+				"--merge", "fixtures/test/BABYLON_EMPTY_CONFIG/dev.yaml",
+				"--overlay-root", "/tmp/doesntexist"},
+			description: "-overlay-root that doesn't exist",
+			result:      controlFlow{true, 1},
+		},
 	}
 
 	for _, tc := range testCases {
@@ -139,6 +166,13 @@ func TestFlag(t *testing.T) {
 		validateFlag = false
 		versionFlag = false
 		gitFlag = false
+		requireCleanFlag = false
+		keyringFlag = ""
+		requireSignedFlag = false
+		gitDirFlag = ""
+		workTreeFlag = ""
+		overlayRootFlag = ""
+		strictFlag = false
 
 		result := parseFlags(tc.args, io.Discard)
 		if tc.result != result {
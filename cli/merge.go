@@ -8,7 +8,6 @@ import (
 	"github.com/go-openapi/jsonpointer"
 	"github.com/imdario/mergo"
 	"github.com/mohae/deepcopy"
-	"os"
 	"os/exec"
 	"path/filepath"
 	"reflect"
@@ -253,6 +252,19 @@ func customStrategyMerge(final map[string]any, source map[string]any, strategy M
 
 var ErrorIncorrectMeta = errors.New("incorrect meta file")
 
+// ErrorDirtyMergeList happens when --require-clean is used and files of the merge list have uncommitted changes.
+var ErrorDirtyMergeList = errors.New("uncommitted changes in merge list")
+
+// ErrorNoGitInfo happens when --require-clean or --require-signed is used
+// and the git information of the catalog item cannot be collected.
+var ErrorNoGitInfo = errors.New("cannot collect git information")
+
+// ErrorNoKeyring happens when --require-signed is used and no keyring is configured.
+var ErrorNoKeyring = errors.New("--require-signed needs a keyring, use --keyring or set 'keyring' in .agnosticv.yaml")
+
+// ErrorUnsignedCommit happens when --require-signed is used and the last commit is not signed by a key of the keyring.
+var ErrorUnsignedCommit = errors.New("last commit is not signed by a trusted key")
+
 func mergeVars(p string, mergeStrategies []MergeStrategy) (map[string]any, []Include, error) {
 	logDebug.Printf("mergeVars(%v)", p)
 
@@ -274,43 +286,75 @@ func mergeVars(p string, mergeStrategies []MergeStrategy) (map[string]any, []Inc
 		return map[string]any{}, []Include{}, err
 	}
 
+	mergeStrategies = mergeStrategiesFor(p, mergeStrategies)
+
 	final := make(map[string]any)
 	mergeListObjects := []map[string]any{}
+	// The merge list, with an entry per document for the files with several documents
+	mergedList := []Include{}
+
+	// A file included with parameters is a template, its placeholders
+	// must be defined wherever it is included
+	templates := map[string]bool{}
+	for _, include := range mergeList {
+		if len(include.params) > 0 {
+			templates[include.path] = true
+		}
+	}
+
 	for i := 0; i < len(mergeList); i = i + 1 {
-		current := make(map[string]any)
+		if mergeList[i].missing() {
+			mergedList = append(mergedList, mergeList[i])
+			continue
+		}
 
-		content, err := os.ReadFile(mergeList[i].path)
+		content, err := readFile(mergeList[i].path)
 		if err != nil {
 			return map[string]any{}, []Include{}, err
 		}
 
-		err = yamljson.Unmarshal(content, &current)
+		if templates[mergeList[i].path] {
+			content, err = mergeList[i].substituteParams(content)
+			if err != nil {
+				return map[string]any{}, []Include{}, err
+			}
+		}
+
+		// The documents are decoded once for the duplicate keys, the tags and the merge
+		documents, err := splitDocuments(content)
 		if err != nil {
-			logErr.Println("cannot unmarshal data when merging",
-				p,
-				". Error is in",
-				mergeList[i].path)
+			logErr.Println("cannot parse data when merging", p, ". Error is in", mergeList[i].path)
 			return map[string]any{}, []Include{}, err
 		}
 
-		if isMetaPath(mergeList[i].path) {
-			// Check if meta file has the __meta__ variable
-			if _, ok := current["__meta__"]; ok {
-				if len(current) > 1 {
-					logErr.Println("Meta file", mergeList[i].path,
-						"has __meta__ key and other variables. Please place only __meta__ in a meta file.")
-					return map[string]any{}, []Include{}, ErrorIncorrectMeta
-				}
-			} else {
-				// Inject content into the __meta__ key
-				newCurrent := make(map[string]any)
-				newCurrent["__meta__"] = current
-				current = newCurrent
-			}
+		if err := checkDuplicateKeys(mergeList[i].path, documents); err != nil {
+			logErr.Println("cannot merge", p, ". Error is in", mergeList[i].path)
+			return map[string]any{}, []Include{}, err
+		}
+
+		// multi_document applies to the files of the directory of its configuration
+		if len(documents) > 1 && configFor(filepath.Dir(mergeList[i].path)).MultiDocument != multiDocumentMerge {
+			logErr.Println("cannot merge", p, ". Error is in", mergeList[i].path)
+			return map[string]any{}, []Include{}, fmt.Errorf(
+				"%w: %s has %d documents, set multi_document to merge in .agnosticv.yaml to merge them in order",
+				ErrorMultiDocument, mergeList[i].path, len(documents))
 		}
 
-		logDebug.Println("(mergelist) append", mergeList[i])
-		mergeListObjects = append(mergeListObjects, current)
+		for d, document := range documents {
+			include := mergeList[i]
+			if len(documents) > 1 {
+				include.document = d + 1
+			}
+
+			current, err := unmarshalMergeListEntry(p, include, document)
+			if err != nil {
+				return map[string]any{}, []Include{}, err
+			}
+
+			logDebug.Println("(mergelist) append", include)
+			mergeListObjects = append(mergeListObjects, current)
+			mergedList = append(mergedList, include)
+		}
 	}
 
 	for _, current := range mergeListObjects {
@@ -366,28 +410,87 @@ func mergeVars(p string, mergeStrategies []MergeStrategy) (map[string]any, []Inc
 		final[k] = v
 	}
 
+	// The guarantees of --require-clean and --require-signed need the git information, never pass without it
+	if (requireCleanFlag || requireSignedFlag) && (!gitFlag || !isRepo(p)) {
+		return map[string]any{}, []Include{}, fmt.Errorf("%w: %s is not in a git repository", ErrorNoGitInfo, p)
+	}
+	if requireSignedFlag && keyringPath() == "" {
+		return map[string]any{}, []Include{}, ErrorNoKeyring
+	}
+
 	// Add Git info to metadata
 	if gitFlag && isRepo(p) {
 
 		var commit *object.Commit
+		var dirty []string
+		// Files from other repositories have no history in this repository
+		related := localIncludes(extendMergeListWithRelated(p, mergeList))
 		_, err := exec.LookPath("git")
 
-		if err != nil {
+		if lastCommitIndex != nil {
+			// History was already walked, use the index
+			commit = lastCommitIndex.findMostRecentCommit(p, related)
+			dirty = lastCommitIndex.findDirtyFiles(p, related)
+		} else if err != nil {
 			// If git is not in PATH, use pure-go
-			commit = findMostRecentCommit(p, extendMergeListWithRelated(p, mergeList))
+			commit = findMostRecentCommit(p, related)
+			dirty = findDirtyFiles(p, related)
 		} else {
 			// Else use git command
-			commit = findMostRecentCommitCmd(p, extendMergeListWithRelated(p, mergeList))
+			commit = findMostRecentCommitCmd(p, related)
+			dirty = findDirtyFilesCmd(p, related)
+		}
+
+		if len(dirty) > 0 && requireCleanFlag {
+			logErr.Println("Uncommitted changes in the merge list of", p, ":", strings.Join(dirty, ", "))
+			return map[string]any{}, []Include{}, ErrorDirtyMergeList
+		}
+
+		// The overlay has its own repository
+		if requireCleanFlag {
+			overlayDirty, err := findOverlayDirtyFiles(extendMergeListWithRelated(p, mergeList))
+			if err != nil {
+				return map[string]any{}, []Include{}, err
+			}
+			if len(overlayDirty) > 0 {
+				logErr.Println("Uncommitted changes in the overlay files of", p, ":", strings.Join(overlayDirty, ", "))
+				return map[string]any{}, []Include{}, ErrorDirtyMergeList
+			}
+		}
+
+		mergeGitInfo := map[string]any{}
+		mergeGitInfo["dirty"] = len(dirty) > 0
+		if len(dirty) > 0 {
+			dirtyFiles := []any{}
+			for _, f := range dirty {
+				dirtyFiles = append(dirtyFiles, f)
+			}
+			mergeGitInfo["dirty_files"] = dirtyFiles
 		}
 
 		if commit != nil {
-			mergeGitInfo := map[string]any{}
 			mergeGitInfo["author"] = fmt.Sprintf("%s <%s>", commit.Author.Name, commit.Author.Email)
 			mergeGitInfo["committer"] = fmt.Sprintf("%s <%s>", commit.Committer.Name, commit.Committer.Email)
 			mergeGitInfo["when_author"] = commit.Author.When.UTC().Format(time.RFC3339)
 			mergeGitInfo["when_committer"] = commit.Committer.When.UTC().Format(time.RFC3339)
 			mergeGitInfo["hash"] = commit.Hash.String()
 			mergeGitInfo["message"] = strings.SplitN(commit.Message, "\n", 10)[0]
+
+			if keyring := keyringPath(); keyring != "" {
+				signature := verifyCommitSignature(filepath.Dir(p), commit, keyring)
+				mergeGitInfo["signature"] = signature
+
+				if requireSignedFlag && signature["status"] != signatureGood {
+					logErr.Println("Last commit", commit.Hash, "of", p, "signature is", signature["status"])
+					return map[string]any{}, []Include{}, ErrorUnsignedCommit
+				}
+			}
+		} else if requireSignedFlag {
+			logErr.Println("No commit found for", p)
+			return map[string]any{}, []Include{}, ErrorUnsignedCommit
+		}
+
+		if commit != nil || len(dirty) > 0 {
 			if err := SetRelative(final, "/__meta__/last_update/git", mergeGitInfo); err != nil {
 				logErr.Fatalf("Error SetRelative: %v", err)
 			}
@@ -395,13 +498,13 @@ func mergeVars(p string, mergeStrategies []MergeStrategy) (map[string]any, []Inc
 	}
 
 	// Add related file content
-	if config.initialized {
-		for _, include := range mergeList {
-			if !isCatalogItem(rootFlag, include.path) {
-				continue
-			}
+	for _, include := range mergeList {
+		if !isCatalogItem(rootFor(include.path), include.path) {
+			continue
+		}
 
-			for _, related := range config.RelatedFilesV2 {
+		if c := configFor(filepath.Dir(include.path)); c.initialized {
+			for _, related := range c.RelatedFilesV2 {
 				if related.LoadInto != "" {
 					if related.ContentKey == "" {
 						logErr.Fatalf("Related file %s has no content key", related.File)
@@ -415,7 +518,7 @@ func mergeVars(p string, mergeStrategies []MergeStrategy) (map[string]any, []Inc
 					for k, v := range related.Set {
 						content[k] = v
 					}
-					relatedContent, err := os.ReadFile(relatedPath)
+					relatedContent, err := readFile(relatedPath)
 					if err != nil {
 						logErr.Fatalf("Error reading related file %s: %v", relatedPath, err)
 					}
@@ -434,14 +537,94 @@ func mergeVars(p string, mergeStrategies []MergeStrategy) (map[string]any, []Inc
 						mergo.WithOverwriteWithEmptyValue,
 						mergo.WithAppendSlice,
 					); err != nil {
-						return final, mergeList, err
+						return final, mergedList, err
 					}
 				}
 			}
 		}
 	}
 
-	return final, mergeList, nil
+	return final, mergedList, nil
+}
+
+// unmarshalMergeListEntry returns the vars of document, a document of the
+// entry include of the merge list of the catalog item p.
+func unmarshalMergeListEntry(p string, include Include, document yamlDocument) (map[string]any, error) {
+	if document.node != nil {
+		changed, err := resolveNodeTags(document.node, include.path)
+		if err != nil {
+			logErr.Println("cannot resolve tags when merging",
+				p,
+				". Error is in",
+				include.path)
+			return map[string]any{}, err
+		}
+		if changed {
+			// Encode the resolved values
+			document.content = nil
+		}
+	}
+
+	content, err := document.encode()
+	if err != nil {
+		return map[string]any{}, err
+	}
+
+	current := make(map[string]any)
+	if err := yamljson.Unmarshal(content, &current); err != nil {
+		logErr.Println("cannot unmarshal data when merging",
+			p,
+			". Error is in",
+			include.path)
+		return map[string]any{}, err
+	}
+
+	// The includes are already in the merge list, they are read from the first document only
+	if _, ok := current[includeKey]; ok && include.document > 1 {
+		return map[string]any{}, fmt.Errorf("%w: %s is only read from the first document, found in document %d of %s",
+			ErrorIncludeKey, includeKey, include.document, include.path)
+	}
+	delete(current, includeKey)
+
+	if include.fragment != "" {
+		// Include only the subtree, as if it were the whole content of the file
+		found, subtree, _, err := Get(current, include.fragment)
+		if err != nil {
+			return map[string]any{}, err
+		}
+		subtreeMap, ok := subtree.(map[string]any)
+		if !found || !ok {
+			return map[string]any{}, fmt.Errorf("%w: %s", ErrorIncludeFragment, include.key())
+		}
+		current = subtreeMap
+	}
+
+	if include.into != "" {
+		// Nest the content under the mount point
+		mounted := make(map[string]any)
+		if err := SetRelative(mounted, include.into, current); err != nil {
+			return map[string]any{}, err
+		}
+		current = mounted
+	}
+
+	if isMetaPath(include.path) {
+		// Check if meta file has the __meta__ variable
+		if _, ok := current["__meta__"]; ok {
+			if len(current) > 1 {
+				logErr.Println("Meta file", include.path,
+					"has __meta__ key and other variables. Please place only __meta__ in a meta file.")
+				return map[string]any{}, ErrorIncorrectMeta
+			}
+		} else {
+			// Inject content into the __meta__ key
+			newCurrent := make(map[string]any)
+			newCurrent["__meta__"] = current
+			current = newCurrent
+		}
+	}
+
+	return current, nil
 }
 
 func initMergeStrategies() {
@@ -468,7 +651,14 @@ func initMergeStrategies() {
 	logDebug.Println("(INIT merge strategies) ", mergeStrategies)
 }
 
-func printMergeStrategies() {
+// mergeStrategiesFor returns the merge strategies to use for the catalog item p:
+// mergeStrategies followed by the ones of the configuration files that apply to p.
+func mergeStrategiesFor(p string, mergeStrategies []MergeStrategy) []MergeStrategy {
+	result := append([]MergeStrategy{}, mergeStrategies...)
+	return append(result, configFor(filepath.Dir(p)).MergeStrategies...)
+}
+
+func printMergeStrategies(mergeStrategies []MergeStrategy) {
 	fmt.Printf("# STRATEGIES:\n")
 	for _, mergeStrategy := range mergeStrategies {
 		fmt.Printf("#   %-15s %s\n", mergeStrategy.Strategy, mergeStrategy.Path)
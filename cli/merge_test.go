@@ -1,7 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"reflect"
 	"strings"
 	"testing"
@@ -447,3 +451,214 @@ func TestRelativeFileLoadInto(t *testing.T) {
 	}
 
 }
+
+func TestMergeTags(t *testing.T) {
+	initLoggers()
+	rootFlag = abs("fixtures")
+	initConf(rootFlag)
+	initSchemaList()
+	initMergeStrategies()
+
+	t.Setenv("AGV_TEST_OWNER", "gpte")
+
+	merged, mergeList, err := mergeVars("fixtures/test/TAGS/tags.yaml", mergeStrategies)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Files loaded with tags are related files
+	related := extendMergeListWithRelated(abs("fixtures/test/TAGS/tags.yaml"), mergeList)
+	for _, p := range []string{
+		"fixtures/includes/tags/sizes.yaml",
+		"fixtures/includes/tags/id.pub",
+		"fixtures/includes/tags/message.j2",
+	} {
+		if !containsPath(related, abs(p)) {
+			t.Error(p, "expected in the related files")
+		}
+	}
+
+	testCases := []struct {
+		pointer  string
+		expected any
+	}{
+		{"/sizes/workers", 3.0},
+		{"/ssh_key", "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFake agnosticv@example.com\n"},
+		{"/__meta__/service_ready/template", "Your service {{ guid }} is ready.\n"},
+		{"/owner", "gpte"},
+	}
+
+	for _, tc := range testCases {
+		if found, value, _, err := Get(merged, tc.pointer); err != nil || !found || value != tc.expected {
+			t.Errorf("expected %s = %q, got %q %v", tc.pointer, tc.expected, value, err)
+		}
+	}
+
+	logErr = log.New(io.Discard, "!!! ", log.LstdFlags)
+	if _, _, err := mergeVars("fixtures/test/TAGS/unset.yaml", mergeStrategies); !errors.Is(err, ErrorTagEnvNotSet) {
+		t.Error("ErrorTagEnvNotSet expected, got", err)
+	}
+
+	if _, _, err := mergeVars("fixtures/test/TAGS/chroot.yaml", mergeStrategies); !errors.Is(err, ErrorTag) {
+		t.Error("ErrorTag expected for a file out of the repo, got", err)
+	}
+
+	// A tag without a path is an error, and is not a related file
+	if related := tagFiles(abs("fixtures/test/TAGS/empty.yaml")); len(related) != 0 {
+		t.Error("no related file expected for an empty tag, got", related)
+	}
+
+	if _, _, err := mergeVars("fixtures/test/TAGS/empty.yaml", mergeStrategies); !errors.Is(err, ErrorTag) {
+		t.Error("ErrorTag expected for an empty tag, got", err)
+	}
+}
+
+func TestMergeMultiDocument(t *testing.T) {
+	initLoggers()
+	rootFlag = abs("fixtures")
+	initConf(rootFlag)
+	initSchemaList()
+	initMergeStrategies()
+
+	t.Setenv("AGV_TEST_OWNER", "gpte")
+
+	merged, mergeList, err := mergeVars("fixtures/test/MULTI_DOCUMENT/dev.yaml", mergeStrategies)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for pointer, expected := range map[string]any{
+		"/purpose": "development",
+		"/size":    "large",
+		"/owner":   "gpte",
+		"/name":    "dev",
+	} {
+		if found, value, _, err := Get(merged, pointer); err != nil || !found || value != expected {
+			t.Errorf("expected %s = %q, got %q %v", pointer, expected, value, err)
+		}
+	}
+
+	keys := []string{}
+	for _, include := range mergeList {
+		keys = append(keys, strings.TrimPrefix(include.key(), rootFlag))
+	}
+	expectedKeys := []string{
+		"/common.yaml",
+		"/test/account.yaml",
+		"/test/MULTI_DOCUMENT/common.yaml[1]",
+		"/test/MULTI_DOCUMENT/common.yaml[2]",
+		"/test/MULTI_DOCUMENT/dev.yaml",
+	}
+	if !reflect.DeepEqual(keys, expectedKeys) {
+		t.Error("expected", expectedKeys, "got", keys)
+	}
+
+	// multi_document is read from the directory of the included file
+	merged, _, err = mergeVars("fixtures/test/MULTI_DOCUMENT_INCLUDE/dev.yaml", mergeStrategies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged["part"] != 2.0 || merged["first"] != true {
+		t.Error("expected both documents of parts.yaml to be merged, got", merged["part"], merged["first"])
+	}
+
+	logErr = log.New(io.Discard, "!!! ", log.LstdFlags)
+	for _, tc := range []struct {
+		path     string
+		expected error
+	}{
+		{"fixtures/test/MULTI_DOCUMENT_ERROR/dev.yaml", ErrorMultiDocument},
+		{"fixtures/test/MULTI_DOCUMENT/include-error.yaml", ErrorMultiDocument},
+		{"fixtures/test/MULTI_DOCUMENT/include-key.yaml", ErrorIncludeKey},
+	} {
+		if _, _, err := mergeVars(tc.path, mergeStrategies); !errors.Is(err, tc.expected) {
+			t.Error(tc.path, ":", tc.expected, "expected, got", err)
+		}
+	}
+
+	// Never merge only the first document of a file that cannot be parsed
+	if _, _, err := mergeVars("fixtures/test/MULTI_DOCUMENT/syntax.yaml", mergeStrategies); err == nil {
+		t.Error("error expected for a syntax error in the second document")
+	}
+}
+
+func TestSplitDocuments(t *testing.T) {
+	initLoggers()
+
+	// A single document is decoded and keeps its content
+	single := []byte("---\nfoo: bar\n")
+	documents, err := splitDocuments(single)
+	if err != nil || len(documents) != 1 || documents[0].node == nil || string(documents[0].content) != string(single) {
+		t.Error("expected one decoded document with its content, got", documents, err)
+	}
+
+	// The nodes of all the documents are shared with the duplicate check
+	documents, err = splitDocuments([]byte("---\nfoo: 1\n---\nbar: 1\nbar: 2\n---\n"))
+	if err != nil || len(documents) != 2 {
+		t.Fatal("expected two documents, got", documents, err)
+	}
+	for _, document := range documents {
+		if document.node == nil || document.content != nil {
+			t.Error("expected a document encoded from its node, got", document)
+		}
+	}
+	if duplicates := findDuplicateKeys(documents); len(duplicates) != 1 || duplicates[0].key != "bar" {
+		t.Error("expected bar as duplicate key, got", duplicates)
+	}
+
+	// A syntax error in a single document is reported by the merge
+	documents, err = splitDocuments([]byte("foo: [bar\n"))
+	if err != nil || len(documents) != 1 || documents[0].node != nil {
+		t.Error("expected the content as is, got", documents, err)
+	}
+
+	if _, err := splitDocuments([]byte("---\nfoo: bar\n---\nfoo: [bar\n")); err == nil {
+		t.Error("expected an error for a syntax error in the second document")
+	}
+}
+
+func TestMergeDuplicateKeys(t *testing.T) {
+	initLoggers()
+	rootFlag = abs("fixtures")
+	initConf(rootFlag)
+	initSchemaList()
+	initMergeStrategies()
+	defer func() { strictFlag = false }()
+
+	var warnings bytes.Buffer
+	logErr = log.New(&warnings, "!!! ", log.LstdFlags)
+
+	merged, _, err := mergeVars("fixtures/test/DUPLICATE_KEYS/dev.yaml", mergeStrategies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged["foo"] != "second" {
+		t.Error("the last value should be kept, got", merged["foo"])
+	}
+
+	for _, expected := range []string{
+		`dev.yaml:5: key "foo" already defined at line 2`,
+		`dev.yaml:11: key "owner" already defined at line 7`,
+	} {
+		if !strings.Contains(warnings.String(), expected) {
+			t.Error("expected warning", expected, "got", warnings.String())
+		}
+	}
+	if strings.Count(warnings.String(), "WARNING") != 2 {
+		t.Error("expected 2 warnings, merge keys can be repeated, got", warnings.String())
+	}
+
+	// Warnings are printed once per file
+	warnings.Reset()
+	if _, _, err := mergeVars("fixtures/test/DUPLICATE_KEYS/dev.yaml", mergeStrategies); err != nil {
+		t.Fatal(err)
+	}
+	if warnings.Len() > 0 {
+		t.Error("warnings should be printed once, got", warnings.String())
+	}
+
+	strictFlag = true
+	if _, _, err := mergeVars("fixtures/test/DUPLICATE_KEYS/dev.yaml", mergeStrategies); !errors.Is(err, ErrorDuplicateKey) {
+		t.Error("ErrorDuplicateKey expected with --strict, got", err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	git "github.com/go-git/go-git/v5"
+)
+
+// With an overlay root, files are looked up in both the base tree (--root)
+// and the overlay tree (--overlay-root). When a file exists in both trees,
+// the file of the overlay is merged right after the file of the base.
+
+// overlayPath returns the path of p in the overlay tree, if p is in the base tree.
+func overlayPath(p string) (string, bool) {
+	if overlayRootFlag == "" || !isRoot(rootFlag, p) {
+		return "", false
+	}
+
+	rel, err := filepath.Rel(rootFlag, p)
+	if err != nil {
+		return "", false
+	}
+
+	return filepath.Join(overlayRootFlag, rel), true
+}
+
+// basePath returns the path of p in the base tree, if p is in the overlay tree.
+func basePath(p string) (string, bool) {
+	if overlayRootFlag == "" || !isRoot(overlayRootFlag, p) {
+		return "", false
+	}
+
+	rel, err := filepath.Rel(overlayRootFlag, p)
+	if err != nil {
+		return "", false
+	}
+
+	return filepath.Join(rootFlag, rel), true
+}
+
+// parseOverlayIncludes returns the file of the overlay matching path, if any,
+// preceded and followed by its own includes, to be merged after path.
+func parseOverlayIncludes(path string, stack []IncludeFrame, processIncludes bool) ([]Include, error) {
+	overlay, ok := overlayPath(path)
+	if !ok || !fileExists(overlay) {
+		return []Include{}, nil
+	}
+
+	before, after, err := parseAllIncludes(overlay, stack, processIncludes)
+	if err != nil {
+		return []Include{}, err
+	}
+
+	result := append(before, Include{path: overlay, recursive: true})
+	return append(result, after...), nil
+}
+
+// findOverlayDirtyFiles returns the files of the list from the overlay tree that
+// have uncommitted changes or are untracked, in the repository of the overlay.
+// Paths are relative to the root of that repository.
+func findOverlayDirtyFiles(files []Include) ([]string, error) {
+	overlayFiles := []Include{}
+	for _, f := range files {
+		if overlayRootFlag != "" && isRoot(overlayRootFlag, f.path) {
+			overlayFiles = append(overlayFiles, f)
+		}
+	}
+	if len(overlayFiles) == 0 {
+		return []string{}, nil
+	}
+
+	repo, err := git.PlainOpenWithOptions(overlayRootFlag, &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return []string{}, fmt.Errorf("%w: overlay root %s is not in a git repository", ErrorNoGitInfo, overlayRootFlag)
+	}
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		return []string{}, err
+	}
+
+	status, err := wt.Status()
+	if err != nil {
+		return []string{}, err
+	}
+
+	return dirtyFiles(wt, status, overlayFiles), nil
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// ErrorUnknownRepository happens when an include refers to a repository
+// that is not defined in the configuration file
+var ErrorUnknownRepository = errors.New("unknown repository")
+
+// ErrorRepositoryRef happens when the ref of a repository include cannot be resolved
+var ErrorRepositoryRef = errors.New("cannot resolve repository ref")
+
+// repositoryTree is another repository, read at the commit of a ref
+type repositoryTree struct {
+	label string // ex: shared@v1.2
+	tree  *object.Tree
+}
+
+// externalRepositories maps the directories of other repositories to their
+// tree. Nothing is written in those directories: the files are read from
+// the commit tree, see statFile() and readFile().
+var externalRepositories = map[string]repositoryTree{}
+
+// repositoryRoots maps the labels of other repositories, ex: shared@v1.2,
+// to their directory. A ref is resolved only once per run.
+var repositoryRoots = map[string]string{}
+
+// repositoriesCacheDir returns the directory where other repositories are cloned.
+func repositoriesCacheDir() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "agnosticv", "repositories"), nil
+}
+
+// isRepositoryURL returns true if the location of a repository is a URL to clone.
+func isRepositoryURL(location string) bool {
+	return strings.Contains(location, "://") || strings.HasPrefix(location, "git@")
+}
+
+// openRepository opens the repository defined by name in the configuration file.
+// Local paths are relative to the root. URLs are cloned in the cache directory,
+// once per URL. Returns true if the repository is a clone that may be outdated.
+func openRepository(name string) (*git.Repository, bool, error) {
+	location, ok := config.Repositories[name]
+	if !ok {
+		return nil, false, fmt.Errorf("%w: %s", ErrorUnknownRepository, name)
+	}
+
+	if !isRepositoryURL(location) {
+		if !filepath.IsAbs(location) {
+			location = filepath.Join(rootFlag, location)
+		}
+		repo, err := git.PlainOpenWithOptions(location, &git.PlainOpenOptions{DetectDotGit: true})
+		return repo, false, err
+	}
+
+	cacheDir, err := repositoriesCacheDir()
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Names are local to a configuration, the same name can refer to different URLs
+	clone := filepath.Join(cacheDir, "clones", fmt.Sprintf("%s-%x.git", name, sha256.Sum256([]byte(location))))
+	if fileExists(clone) {
+		repo, err := git.PlainOpen(clone)
+		return repo, true, err
+	}
+
+	logDebug.Println("cloning", location, "into", clone)
+	repo, err := git.PlainClone(clone, true, &git.CloneOptions{URL: location, Tags: git.AllTags})
+	return repo, false, err
+}
+
+// isFixedRef returns true if ref is a commit hash or a tag of the repository.
+// Other refs, like branches, can move.
+func isFixedRef(repo *git.Repository, ref string) bool {
+	if plumbing.IsHash(ref) {
+		return true
+	}
+	_, err := repo.Tag(ref)
+	return err == nil
+}
+
+// resolveRepositoryRef returns the commit of ref in the repository.
+// With fetch, the remote is fetched if ref is unknown or can move.
+func resolveRepositoryRef(repo *git.Repository, ref string, fetch bool) (*object.Commit, error) {
+	hash, err := repo.ResolveRevision(plumbing.Revision(ref))
+	if fetch && (err != nil || !isFixedRef(repo, ref)) {
+		logDebug.Println("fetching", ref)
+		err = repo.Fetch(&git.FetchOptions{
+			RefSpecs: []gitconfig.RefSpec{"+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*"},
+		})
+		if err != nil && err != git.NoErrAlreadyUpToDate {
+			return nil, err
+		}
+		hash, err = repo.ResolveRevision(plumbing.Revision(ref))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Annotated tag
+	if tag, err := repo.TagObject(*hash); err == nil {
+		return tag.Commit()
+	}
+
+	return repo.CommitObject(*hash)
+}
+
+// repositoryRoot returns the directory of the repository name at ref.
+// Its files are read from the commit tree.
+func repositoryRoot(name string, ref string) (string, error) {
+	label := name + "@" + ref
+	if dir, ok := repositoryRoots[label]; ok {
+		return dir, nil
+	}
+
+	repo, fetch, err := openRepository(name)
+	if err != nil {
+		return "", err
+	}
+
+	commit, err := resolveRepositoryRef(repo, ref, fetch)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s: %v", ErrorRepositoryRef, label, err)
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return "", err
+	}
+
+	cacheDir, err := repositoriesCacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	// One directory per label, so refs of the same commit keep their label
+	dir := filepath.Join(cacheDir, "trees", url.PathEscape(label))
+	logDebug.Println("reading", label, "at", commit.Hash, "as", dir)
+	externalRepositories[dir] = repositoryTree{label: label, tree: tree}
+	repositoryRoots[label] = dir
+
+	return dir, nil
+}
+
+// externalRepository returns the directory and the label of the other
+// repository containing p, or false if p is not in another repository.
+func externalRepository(p string) (string, string, bool) {
+	for dir, repository := range externalRepositories {
+		if isRoot(dir, p) {
+			return dir, repository.label, true
+		}
+	}
+	return "", "", false
+}
+
+// externalTreePath returns the tree of the other repository containing p
+// and the path of p in that tree, or false if p is not in another repository.
+func externalTreePath(p string) (*object.Tree, string, bool) {
+	dir, _, ok := externalRepository(p)
+	if !ok {
+		return nil, "", false
+	}
+	rel := strings.TrimPrefix(filepath.ToSlash(strings.TrimPrefix(p, dir)), "/")
+	return externalRepositories[dir].tree, rel, true
+}
+
+// treeFileInfo describes a file or a directory of a tree
+type treeFileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (info treeFileInfo) Name() string       { return info.name }
+func (info treeFileInfo) Size() int64        { return info.size }
+func (info treeFileInfo) ModTime() time.Time { return time.Time{} }
+func (info treeFileInfo) IsDir() bool        { return info.dir }
+func (info treeFileInfo) Sys() any           { return nil }
+func (info treeFileInfo) Mode() fs.FileMode {
+	if info.dir {
+		return fs.ModeDir | 0o755
+	}
+	return 0o644
+}
+
+// maxTreeSymlinks is the maximum number of symlinks followed to find a file in a tree
+const maxTreeSymlinks = 40
+
+// findTreeEntry returns the entry of the file or the directory rel in tree,
+// following the symlinks, and its path. The root of the tree has no entry.
+func findTreeEntry(tree *object.Tree, rel string) (*object.TreeEntry, string, error) {
+	for i := 0; i < maxTreeSymlinks; i++ {
+		if rel == "" || rel == "." {
+			return nil, "", nil
+		}
+
+		entry, err := tree.FindEntry(rel)
+		if err != nil {
+			return nil, rel, fs.ErrNotExist
+		}
+
+		switch entry.Mode {
+		case filemode.Submodule:
+			return nil, rel, fs.ErrNotExist
+		case filemode.Symlink:
+			file, err := tree.TreeEntryFile(entry)
+			if err != nil {
+				return nil, rel, err
+			}
+			target, err := file.Contents()
+			if err != nil {
+				return nil, rel, err
+			}
+			if path.IsAbs(target) {
+				return nil, rel, fs.ErrNotExist
+			}
+			rel = path.Join(path.Dir(rel), target)
+			if rel == ".." || strings.HasPrefix(rel, "../") {
+				// Out of the repository
+				return nil, rel, fs.ErrNotExist
+			}
+		default:
+			return entry, rel, nil
+		}
+	}
+	return nil, rel, fmt.Errorf("too many levels of symbolic links")
+}
+
+// statFile returns the description of the file p, from the tree of the
+// other repository if p is in one, from the filesystem otherwise.
+func statFile(p string) (fs.FileInfo, error) {
+	tree, rel, ok := externalTreePath(p)
+	if !ok {
+		return os.Stat(p)
+	}
+
+	entry, rel, err := findTreeEntry(tree, rel)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: p, Err: err}
+	}
+	if entry == nil || entry.Mode == filemode.Dir {
+		return treeFileInfo{name: filepath.Base(p), dir: true}, nil
+	}
+
+	size, err := tree.Size(rel)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: p, Err: err}
+	}
+	return treeFileInfo{name: filepath.Base(p), size: size}, nil
+}
+
+// readFile returns the content of the file p, from the tree of the other
+// repository if p is in one, from the filesystem otherwise.
+func readFile(p string) ([]byte, error) {
+	tree, rel, ok := externalTreePath(p)
+	if !ok {
+		return os.ReadFile(p)
+	}
+
+	entry, _, err := findTreeEntry(tree, rel)
+	if err == nil && (entry == nil || entry.Mode == filemode.Dir) {
+		err = errors.New("is a directory")
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: p, Err: err}
+	}
+
+	file, err := tree.TreeEntryFile(entry)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: p, Err: err}
+	}
+	content, err := file.Contents()
+	return []byte(content), err
+}
+
+// readDir returns the entries of the directory p, sorted by name, from the
+// tree of the other repository if p is in one, from the filesystem otherwise.
+func readDir(p string) ([]fs.DirEntry, error) {
+	tree, rel, ok := externalTreePath(p)
+	if !ok {
+		return os.ReadDir(p)
+	}
+
+	entry, rel, err := findTreeEntry(tree, rel)
+	if err == nil && entry != nil {
+		if entry.Mode != filemode.Dir {
+			err = errors.New("not a directory")
+		} else {
+			tree, err = tree.Tree(rel)
+		}
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: p, Err: err}
+	}
+
+	result := []fs.DirEntry{}
+	for _, e := range tree.Entries {
+		if e.Mode == filemode.Submodule {
+			continue
+		}
+		info, err := statFile(filepath.Join(p, e.Name))
+		if err != nil {
+			continue
+		}
+		result = append(result, fs.FileInfoToDirEntry(info))
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name() < result[j].Name() })
+
+	return result, nil
+}
+
+// globFiles returns the files matching pattern, sorted, from the tree of
+// the other repository if pattern is in one, from the filesystem otherwise.
+func globFiles(pattern string) ([]string, error) {
+	tree, rel, ok := externalTreePath(pattern)
+	if !ok {
+		return filepath.Glob(pattern)
+	}
+	if _, err := path.Match(rel, ""); err != nil {
+		return nil, err
+	}
+
+	dir := strings.TrimSuffix(pattern, filepath.FromSlash(rel))
+	result := []string{}
+	err := tree.Files().ForEach(func(f *object.File) error {
+		if matched, _ := path.Match(rel, f.Name); matched {
+			result = append(result, filepath.Join(dir, filepath.FromSlash(f.Name)))
+		}
+		return nil
+	})
+	sort.Strings(result)
+
+	return result, err
+}
+
+// rootFor returns the root to resolve the includes of p: the top of the
+// other repository if p comes from one, the overlay root if p is in the
+// overlay, rootFlag otherwise.
+func rootFor(p string) string {
+	if dir, _, ok := externalRepository(p); ok {
+		return dir
+	}
+	if overlayRootFlag != "" && isRoot(overlayRootFlag, p) {
+		return overlayRootFlag
+	}
+	return rootFlag
+}
+
+// displayPath returns p as label:/path if p comes from another repository, p otherwise.
+func displayPath(p string) string {
+	if dir, label, ok := externalRepository(p); ok {
+		return label + ":" + strings.TrimPrefix(p, dir)
+	}
+	return p
+}
+
+// localIncludes returns the includes that are in the root, and not from
+// other repositories nor from the overlay.
+func localIncludes(l []Include) []Include {
+	result := []Include{}
+	for _, include := range l {
+		if _, _, ok := externalRepository(include.path); ok {
+			continue
+		}
+		if !isRoot(rootFlag, include.path) {
+			continue
+		}
+		result = append(result, include)
+	}
+	return result
+}
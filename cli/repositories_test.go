@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"path/filepath"
+	"testing"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// commitTestFiles writes files in the repository dir and commits them.
+// Returns the hash of the commit.
+func commitTestFiles(t *testing.T, dir string, files map[string]string) plumbing.Hash {
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFiles(t, dir, files)
+	for name := range files {
+		if _, err := wt.Add(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hash, err := wt.Commit("update", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+// resetRepositories forgets the other repositories read, as in a new run.
+func resetRepositories() {
+	externalRepositories = map[string]repositoryTree{}
+	repositoryRoots = map[string]string{}
+}
+
+func TestIncludeRepository(t *testing.T) {
+	initLoggers()
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	resetRepositories()
+	defer resetRepositories()
+
+	shared := initTestRepo(t, map[string]string{
+		"includes/base.yaml":   "#include ./nested.yaml\nfrom_shared: v1\n",
+		"includes/nested.yaml": "from_nested: v1\n",
+		"includes/all/a.yaml":  "from_a: v1\n",
+		"includes/all/b.yaml":  "from_b: v1\n",
+	})
+	repo, err := git.PlainOpen(shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range []string{"v1", "v1.0"} {
+		if _, err := repo.CreateTag(tag, head.Hash(), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Change the file after the tag, the tagged content is expected
+	commitTestFiles(t, shared, map[string]string{"includes/base.yaml": "from_shared: v2\n"})
+
+	dir := initTestRepo(t, map[string]string{
+		".agnosticv.yaml":  "repositories:\n  shared: " + shared + "\n",
+		"catalog/dev.yaml": "#include repo=shared@v1 /includes/base.yaml\n#include repo=shared@v1.0 /includes/all/*.yaml\nfrom_leaf: dev\n",
+		"catalog/bad.yaml": "#include repo=unknown@v1 /includes/base.yaml\n",
+	})
+
+	rootFlag = dir
+	initConf(rootFlag)
+	initMergeStrategies()
+	defer func() {
+		rootFlag = abs("fixtures")
+		initConf(rootFlag)
+		initMergeStrategies()
+	}()
+
+	merged, mergeList, err := mergeVars(filepath.Join(dir, "catalog/dev.yaml"), mergeStrategies)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"from_shared", "from_nested", "from_a", "from_b"} {
+		if merged[key] != "v1" {
+			t.Error("expected the content of the v1 tag for", key, "got", merged[key])
+		}
+	}
+
+	// Both tags point to the same commit, each keeps its label
+	expected := []string{
+		"shared@v1:/includes/nested.yaml",
+		"shared@v1:/includes/base.yaml",
+		"shared@v1.0:/includes/all/a.yaml",
+		"shared@v1.0:/includes/all/b.yaml",
+	}
+	for i, e := range expected {
+		if got := displayPath(mergeList[i].path); got != e {
+			t.Error("expected", e, "at position", i, "got", got)
+		}
+	}
+
+	if len(localIncludes(mergeList)) != 1 {
+		t.Error("expected only the leaf in the local includes, got", localIncludes(mergeList))
+	}
+
+	// The files are read from the commit, nothing is written
+	if cacheDir, err := repositoriesCacheDir(); err != nil || fileExists(cacheDir) {
+		t.Error("nothing expected in the cache directory", cacheDir, err)
+	}
+
+	logErr = log.New(io.Discard, "!!! ", log.LstdFlags)
+	if _, _, err := mergeVars(filepath.Join(dir, "catalog/bad.yaml"), mergeStrategies); !errors.Is(err, ErrorUnknownRepository) {
+		t.Error("ErrorUnknownRepository expected, got", err)
+	}
+}
+
+func TestIncludeRepositoryURL(t *testing.T) {
+	initLoggers()
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	resetRepositories()
+	defer resetRepositories()
+
+	shared := initTestRepo(t, map[string]string{"base.yaml": "from_shared: v1\n"})
+	other := initTestRepo(t, map[string]string{"base.yaml": "from_shared: other\n"})
+
+	dir := initTestRepo(t, map[string]string{
+		".agnosticv.yaml":  "repositories:\n  shared: file://" + shared + "\n",
+		"catalog/dev.yaml": "#include repo=shared@master /base.yaml\n",
+	})
+
+	rootFlag = dir
+	initConf(rootFlag)
+	initMergeStrategies()
+	defer func() {
+		rootFlag = abs("fixtures")
+		initConf(rootFlag)
+		initMergeStrategies()
+	}()
+
+	merge := func() any {
+		resetRepositories()
+		merged, _, err := mergeVars(filepath.Join(dir, "catalog/dev.yaml"), mergeStrategies)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return merged["from_shared"]
+	}
+
+	if got := merge(); got != "v1" {
+		t.Error("expected v1, got", got)
+	}
+
+	// The branch moved, the cached clone is fetched
+	commitTestFiles(t, shared, map[string]string{"base.yaml": "from_shared: v2\n"})
+	if got := merge(); got != "v2" {
+		t.Error("expected v2 after the branch moved, got", got)
+	}
+
+	// The same name with another URL does not use the same clone
+	config.Repositories["shared"] = "file://" + other
+	if got := merge(); got != "other" {
+		t.Error("expected the content of the other URL, got", got)
+	}
+}
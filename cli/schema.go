@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
 
 	"github.com/getkin/kin-openapi/openapi3"
 	jsonyaml "github.com/ghodss/yaml"
@@ -82,8 +81,8 @@ func getSchemaList() ([]Schema, error) {
 			logErr.Printf("%q: %v\n", p, err)
 			return err
 		}
-		// Work only with YAML files
-		if !strings.HasSuffix(p, ".yml") && !strings.HasSuffix(p, ".yaml") {
+		// Work only with YAML or JSON files
+		if !hasVarsExtension(p) {
 			return nil
 		}
 
@@ -96,6 +95,13 @@ func getSchemaList() ([]Schema, error) {
 			return err
 		}
 
+		// Syntax errors are reported when converting the schema
+		if documents, err := splitDocuments(content); err == nil {
+			if err := checkDuplicateKeys(pAbs, documents); err != nil {
+				return err
+			}
+		}
+
 		// 2. convert to object
 
 		schema := new(AgnosticvSchema)
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// Value-level tags, resolved when merging:
+//
+//	ssh_key: !file ./keys/id.pub          # YAML content of the file
+//	template: !file-content ./msg.j2      # raw content of the file, as a string
+//	owner: !env AGV_OWNER                 # value of the environment variable
+const (
+	tagFile        = "!file"
+	tagFileContent = "!file-content"
+	tagEnv         = "!env"
+)
+
+// ErrorTagEnvNotSet happens when the variable of an !env tag is not set
+var ErrorTagEnvNotSet = errors.New("environment variable not set")
+
+// ErrorTag happens when a tag cannot be resolved
+var ErrorTag = errors.New("cannot resolve tag")
+
+// hasTags returns true if the content may use value-level tags.
+func hasTags(content []byte) bool {
+	return bytes.Contains(content, []byte(tagFile)) || bytes.Contains(content, []byte(tagEnv))
+}
+
+// tagFiles returns the files loaded with the tags !file and !file-content in the file p.
+// They are related files of the catalog items merging p.
+func tagFiles(p string) []string {
+	content, err := readFile(p)
+	if err != nil || !hasTags(content) {
+		return []string{}
+	}
+
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal(content, &doc); err != nil {
+		// Syntax errors are reported by the merge
+		return []string{}
+	}
+
+	return findNodeTagFiles(&doc, p)
+}
+
+// findNodeTagFiles returns the files loaded with tags in node and its children.
+// Paths that cannot be resolved are reported by the merge.
+func findNodeTagFiles(node *yamlv3.Node, contextFile string) []string {
+	result := []string{}
+
+	if node.Kind == yamlv3.ScalarNode && node.Value != "" && (node.Tag == tagFile || node.Tag == tagFileContent) {
+		if p, err := resolvePath(rootFor(contextFile), node.Value, contextFile); err == nil {
+			result = append(result, p)
+		}
+	}
+
+	for _, child := range node.Content {
+		result = append(result, findNodeTagFiles(child, contextFile)...)
+	}
+
+	return result
+}
+
+// resolveNodeTags walks the node and replaces the values using the tags !file, !file-content and !env.
+// Paths are resolved like includes, relative to contextFile, and must be inside the repo.
+// Returns true if at least one value was replaced.
+func resolveNodeTags(node *yamlv3.Node, contextFile string) (bool, error) {
+	changed := false
+
+	if node.Kind == yamlv3.ScalarNode {
+		switch node.Tag {
+		case tagFile, tagFileContent:
+			if node.Value == "" {
+				return false, fmt.Errorf("%w: line %d: %s needs a path", ErrorTag, node.Line, node.Tag)
+			}
+
+			p, err := resolvePath(rootFor(contextFile), node.Value, contextFile)
+			if err != nil {
+				return false, fmt.Errorf("%w: line %d: %s %s: %v", ErrorTag, node.Line, node.Tag, node.Value, err)
+			}
+
+			content, err := readFile(p)
+			if err != nil {
+				return false, fmt.Errorf("%w: line %d: %s %s: %v", ErrorTag, node.Line, node.Tag, node.Value, err)
+			}
+
+			if node.Tag == tagFileContent {
+				*node = yamlv3.Node{Kind: yamlv3.ScalarNode, Tag: "!!str", Value: string(content)}
+				return true, nil
+			}
+
+			var fileDoc yamlv3.Node
+			if err := yamlv3.Unmarshal(content, &fileDoc); err != nil {
+				return false, fmt.Errorf("%w: line %d: %s %s: %v", ErrorTag, node.Line, node.Tag, node.Value, err)
+			}
+			if len(fileDoc.Content) == 0 {
+				// Empty file
+				*node = yamlv3.Node{Kind: yamlv3.ScalarNode, Tag: "!!null"}
+			} else {
+				*node = *fileDoc.Content[0]
+			}
+			return true, nil
+
+		case tagEnv:
+			value, ok := os.LookupEnv(node.Value)
+			if !ok {
+				return false, fmt.Errorf("%w: line %d: %s", ErrorTagEnvNotSet, node.Line, node.Value)
+			}
+			*node = yamlv3.Node{Kind: yamlv3.ScalarNode, Tag: "!!str", Value: value}
+			return true, nil
+		}
+	}
+
+	for _, child := range node.Content {
+		childChanged, err := resolveNodeTags(child, contextFile)
+		if err != nil {
+			return false, err
+		}
+		changed = changed || childChanged
+	}
+
+	return changed, nil
+}